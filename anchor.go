@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// anchorExtmarkOffset is added to the ID of a codeblock for the id of the
+// extmark anchoring it. Its stdout and stderr out blocks use the next ones
+const anchorExtmarkOffset = 4
+
+// anchorExtmarkID returns the id of the extmark anchoring the codeblock
+func (cb *Codeblock) anchorExtmarkID() (int, error) {
+	if cb.Opts[CbOptID] != "" {
+		id, err := strconv.Atoi(cb.Opts[CbOptID])
+		return id + anchorExtmarkOffset, err
+	}
+	id, err := cb.sourceExtmarkID()
+	if err != nil {
+		return 0, err
+	}
+	if cb.IsStderrTarget() {
+		return id + anchorExtmarkOffset + 2, nil
+	}
+	return id + anchorExtmarkOffset + 1, nil
+}
+
+// Anchor tracks the lines of the codeblock while it's running. It's written
+// where its anchor is, so output lands in the right place when lines are
+// added or removed above it or its fence is edited
+func (cb *Codeblock) Anchor() error {
+	id, err := cb.anchorExtmarkID()
+	if err != nil {
+		return err
+	}
+	if err := cb.Document.SetAnchor(id, cb.StartLine, cb.EndLine); err != nil {
+		return err
+	}
+	cb.anchor = id
+	return nil
+}
+
+// Release removes the anchor of the codeblock, if it has one
+func (cb *Codeblock) Release() {
+	if cb == nil || cb.anchor == 0 {
+		return
+	}
+	if err := cb.Document.RemoveAnchor(cb.anchor); err != nil {
+		log.Errorf("Couldn't remove anchor of %s: %v", cb.Ref(), err)
+	}
+	cb.anchor = 0
+}
+
+// releaseAnchors releases the anchors of all given codeblocks, which can be
+// nil
+func releaseAnchors(codeblocks ...*Codeblock) {
+	for _, cb := range codeblocks {
+		cb.Release()
+	}
+}
+
+// reanchor moves the anchor of an anchored codeblock to its current lines
+func (cb *Codeblock) reanchor() error {
+	if cb.anchor == 0 {
+		return nil
+	}
+	return cb.Document.SetAnchor(cb.anchor, cb.StartLine, cb.EndLine)
+}
+
+// Locate moves the codeblock to the lines of its anchor. Returns false when
+// it isn't anchored or the anchor doesn't span a codeblock anymore, e.g.
+// because its lines were deleted
+func (cb *Codeblock) Locate() (bool, error) {
+	if cb.anchor == 0 {
+		return false, nil
+	}
+	start, end, ok, err := cb.Document.Anchor(cb.anchor)
+	if err != nil || !ok {
+		return false, err
+	}
+	md, err := cb.Document.Markdown()
+	if err != nil {
+		return false, err
+	}
+	block, ok := md.blockAt(start)
+	if !ok || block.start != start || block.end != end {
+		return false, nil
+	}
+
+	cb.StartLine = start
+	cb.EndLine = end
+	cb.Fence = block.fence
+	return true, nil
+}
+
+// anchoredLine returns the first line of the anchor of the codeblock, or its
+// start line when it isn't anchored
+func (cb *Codeblock) anchoredLine() int {
+	if cb.anchor == 0 {
+		return cb.StartLine
+	}
+	start, _, ok, err := cb.Document.Anchor(cb.anchor)
+	if err != nil || !ok {
+		return cb.StartLine
+	}
+	return start
+}
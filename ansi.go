@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// AnsiRender removes color sequences from the output and highlights the
+	// text instead
+	AnsiRender = "render"
+	// AnsiStrip removes color sequences from the output
+	AnsiStrip = "strip"
+)
+
+// ansiSequence matches CSI sequences, charset selection, OSC strings and
+// other two byte escape sequences
+var ansiSequence = regexp.MustCompile("\x1b(?:\\[[0-9;:?<=>]*[ -/]*[@-~]|[()][0-9A-Za-z]|\\][^\x07\x1b]*(?:\x07|\x1b\\\\)|[@-Z\\\\-_])")
+
+// TextStyle is the style set by SGR sequences. Colors are 0xRRGGBB, the
+// cterm colors the index in the 256 color palette. -1 means unset
+type TextStyle struct {
+	Fg            int
+	Bg            int
+	CtermFg       int
+	CtermBg       int
+	Bold          bool
+	Italic        bool
+	Underline     bool
+	Reverse       bool
+	Strikethrough bool
+}
+
+// DefaultTextStyle is the style without any SGR attributes
+var DefaultTextStyle = TextStyle{Fg: -1, Bg: -1, CtermFg: -1, CtermBg: -1}
+
+// HighlightGroup returns the name of the highlight group for the style
+func (st TextStyle) HighlightGroup() string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%+v", st)
+	return fmt.Sprintf("MdrunAnsi%08x", h.Sum32())
+}
+
+// HighlightAttrs returns the attributes of the highlight group for the style,
+// as passed to nvim_set_hl
+func (st TextStyle) HighlightAttrs() map[string]any {
+	attrs := map[string]any{}
+	if st.Fg != -1 {
+		attrs["fg"] = fmt.Sprintf("#%06x", st.Fg)
+	}
+	if st.Bg != -1 {
+		attrs["bg"] = fmt.Sprintf("#%06x", st.Bg)
+	}
+	if st.CtermFg != -1 {
+		attrs["ctermfg"] = st.CtermFg
+	}
+	if st.CtermBg != -1 {
+		attrs["ctermbg"] = st.CtermBg
+	}
+	for name, set := range map[string]bool{
+		"bold":          st.Bold,
+		"italic":        st.Italic,
+		"underline":     st.Underline,
+		"reverse":       st.Reverse,
+		"strikethrough": st.Strikethrough,
+	} {
+		if set {
+			attrs[name] = true
+		}
+	}
+	return attrs
+}
+
+// Highlight styles the bytes StartCol up to EndCol of a line
+type Highlight struct {
+	Line     int
+	StartCol int
+	EndCol   int
+	Style    TextStyle
+	// Link is an existing highlight group used instead of Style, if set
+	Link string
+}
+
+// ParseANSI removes all escape sequences from text and returns the
+// highlights for the parts styled by SGR sequences. Lines are relative to
+// the start of text, columns are byte offsets
+func ParseANSI(text string) (string, []Highlight) {
+	highlights := []Highlight{}
+	style := DefaultTextStyle
+	lines := strings.Split(text, "\n")
+
+	for lineIdx, line := range lines {
+		var sb strings.Builder
+		addSegment := func(segment string) {
+			if segment == "" {
+				return
+			}
+			start := sb.Len()
+			sb.WriteString(segment)
+			if style == DefaultTextStyle {
+				return
+			}
+			last := len(highlights) - 1
+			if last >= 0 && highlights[last].Line == lineIdx && highlights[last].EndCol == start && highlights[last].Style == style {
+				highlights[last].EndCol = sb.Len()
+				return
+			}
+			highlights = append(highlights, Highlight{
+				Line:     lineIdx,
+				StartCol: start,
+				EndCol:   sb.Len(),
+				Style:    style,
+			})
+		}
+
+		pos := 0
+		for _, match := range ansiSequence.FindAllStringIndex(line, -1) {
+			addSegment(line[pos:match[0]])
+			sequence := line[match[0]:match[1]]
+			if strings.HasPrefix(sequence, "\x1b[") && strings.HasSuffix(sequence, "m") {
+				style = applySGR(style, sequence[2:len(sequence)-1])
+			}
+			pos = match[1]
+		}
+		addSegment(line[pos:])
+		lines[lineIdx] = sb.String()
+	}
+
+	return strings.Join(lines, "\n"), highlights
+}
+
+// StripANSI removes all escape sequences from text
+func StripANSI(text string) string {
+	plain, _ := ParseANSI(text)
+	return plain
+}
+
+// applySGR returns the style after the SGR sequence with the given parameters
+func applySGR(style TextStyle, params string) TextStyle {
+	codes := []int{}
+	for _, param := range strings.FieldsFunc(params, func(r rune) bool { return r == ';' || r == ':' }) {
+		code, err := strconv.Atoi(param)
+		if err != nil {
+			return style
+		}
+		codes = append(codes, code)
+	}
+	if len(codes) == 0 {
+		codes = []int{0}
+	}
+
+	for i := 0; i < len(codes); i++ {
+		code := codes[i]
+		switch {
+		case code == 0:
+			style = DefaultTextStyle
+		case code == 1:
+			style.Bold = true
+		case code == 3:
+			style.Italic = true
+		case code == 4:
+			style.Underline = true
+		case code == 7:
+			style.Reverse = true
+		case code == 9:
+			style.Strikethrough = true
+		case code == 21 || code == 22:
+			style.Bold = false
+		case code == 23:
+			style.Italic = false
+		case code == 24:
+			style.Underline = false
+		case code == 27:
+			style.Reverse = false
+		case code == 29:
+			style.Strikethrough = false
+		case code >= 30 && code <= 37:
+			style.Fg, style.CtermFg = paletteColor(code-30), code-30
+		case code >= 90 && code <= 97:
+			style.Fg, style.CtermFg = paletteColor(code-90+8), code-90+8
+		case code == 39:
+			style.Fg, style.CtermFg = -1, -1
+		case code >= 40 && code <= 47:
+			style.Bg, style.CtermBg = paletteColor(code-40), code-40
+		case code >= 100 && code <= 107:
+			style.Bg, style.CtermBg = paletteColor(code-100+8), code-100+8
+		case code == 49:
+			style.Bg, style.CtermBg = -1, -1
+		case code == 38 || code == 48:
+			color, cterm, n := extendedColor(codes[i+1:])
+			i += n
+			if color == -1 {
+				continue
+			}
+			if code == 38 {
+				style.Fg, style.CtermFg = color, cterm
+			} else {
+				style.Bg, style.CtermBg = color, cterm
+			}
+		}
+	}
+	return style
+}
+
+// extendedColor parses the arguments of a 38 or 48 SGR code, either
+// 5;INDEX or 2;R;G;B. Returns the color, the cterm color and the number of
+// arguments used
+func extendedColor(args []int) (int, int, int) {
+	if len(args) >= 2 && args[0] == 5 {
+		return paletteColor(args[1]), args[1], 2
+	}
+	if len(args) >= 4 && args[0] == 2 {
+		return args[1]<<16 | args[2]<<8 | args[3], -1, 4
+	}
+	return -1, -1, len(args)
+}
+
+// ansiBasicColors are the xterm defaults of the first 16 colors
+var ansiBasicColors = []int{
+	0x000000, 0xcd0000, 0x00cd00, 0xcdcd00, 0x0000ee, 0xcd00cd, 0x00cdcd, 0xe5e5e5,
+	0x7f7f7f, 0xff0000, 0x00ff00, 0xffff00, 0x5c5cff, 0xff00ff, 0x00ffff, 0xffffff,
+}
+
+// paletteColor returns the color at index of the xterm 256 color palette
+func paletteColor(index int) int {
+	switch {
+	case index < 0 || index > 255:
+		return -1
+	case index < 16:
+		return ansiBasicColors[index]
+	case index < 232:
+		levels := []int{0, 95, 135, 175, 215, 255}
+		index -= 16
+		return levels[index/36]<<16 | levels[index/6%6]<<8 | levels[index%6]
+	default:
+		gray := 8 + 10*(index-232)
+		return gray<<16 | gray<<8 | gray
+	}
+}
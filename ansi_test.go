@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseANSI(t *testing.T) {
+	red := DefaultTextStyle
+	red.Fg = 0xcd0000
+	red.CtermFg = 1
+	boldRed := red
+	boldRed.Bold = true
+	truecolor := DefaultTextStyle
+	truecolor.Fg = 0x102030
+	palette196 := DefaultTextStyle
+	palette196.Fg = 0xff0000
+	palette196.CtermFg = 196
+
+	tests := []struct {
+		name       string
+		text       string
+		plain      string
+		highlights []Highlight
+	}{
+		{"plain", "text", "text", []Highlight{}},
+		{"color", "a\x1b[31mred\x1b[0mb", "aredb", []Highlight{{Line: 0, StartCol: 1, EndCol: 4, Style: red}}},
+		{"style carries over lines", "\x1b[31ma\nb\x1b[m", "a\nb", []Highlight{{Line: 0, StartCol: 0, EndCol: 1, Style: red}, {Line: 1, StartCol: 0, EndCol: 1, Style: red}}},
+		{"combined attributes", "\x1b[1;31mx", "x", []Highlight{{Line: 0, StartCol: 0, EndCol: 1, Style: boldRed}}},
+		{"same style is merged", "\x1b[31ma\x1b[31mb", "ab", []Highlight{{Line: 0, StartCol: 0, EndCol: 2, Style: red}}},
+		{"truecolor", "\x1b[38;2;16;32;48mx", "x", []Highlight{{Line: 0, StartCol: 0, EndCol: 1, Style: truecolor}}},
+		{"256 colors", "\x1b[38;5;196mx", "x", []Highlight{{Line: 0, StartCol: 0, EndCol: 1, Style: palette196}}},
+		{"other sequences", "\x1b[2K\x1b(Bx\x1b]0;t\x07", "x", []Highlight{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain, highlights := ParseANSI(tt.text)
+			if plain != tt.plain {
+				t.Errorf("text = %q, want %q", plain, tt.plain)
+			}
+			if !reflect.DeepEqual(highlights, tt.highlights) {
+				t.Errorf("highlights = %+v, want %+v", highlights, tt.highlights)
+			}
+		})
+	}
+}
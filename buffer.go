@@ -11,7 +11,9 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-var BufferLines = map[int][]string{}
+// BufferMarkdown holds the parsed lines of every attached buffer. It's kept
+// up to date by the buffer events, which are parsed incrementally
+var BufferMarkdown = map[int]*Markdown{}
 var bufferLinesMutex = sync.RWMutex{}
 
 var bufLineEventsQueue chan *nvim.BufLinesEvent = make(chan *nvim.BufLinesEvent)
@@ -47,46 +49,43 @@ func bufferLinesEventLoop() {
 
 func receiveBufferLine() {
 	event := <-bufLineEventsQueue
-	// returns a copy of the buffer
-	lines, ok := BufferLines[int(event.Buffer)]
-	bufLines := make([]string, len(lines))
-	copy(bufLines, lines)
+	bufferLinesMutex.RLock()
+	md, ok := BufferMarkdown[int(event.Buffer)]
+	bufferLinesMutex.RUnlock()
 
 	if !ok {
 		if event.FirstLine != 0 || event.LastLine != -1 {
 			log.Warnf("Got updated for an unknown buffer: %d, but it's not the initla one. ignoring", event.Buffer)
 		} else {
-			SetBufferLines(event.Buffer, event.LineData)
+			SetBufferMarkdown(event.Buffer, ParseMarkdown(event.LineData))
 		}
-    blockCount := &atomic.Int32{}
+		blockCount := &atomic.Int32{}
 		bufferUnblockedChannels[int(event.Buffer)] = blockCount
 		return
 	}
 
-	newLines := []string{}
-	newLines = append(newLines, bufLines[:event.FirstLine]...)
-	newLines = append(newLines, event.LineData...)
-  if event.LastLine != -1 {
-    newLines = append(newLines, bufLines[event.LastLine:]...)
-  } else {
-    log.Warnf("lastline from event is -1 weirdly: %+v", event)
-  }
+	lastLine := int(event.LastLine)
+	if event.LastLine == -1 {
+		log.Warnf("lastline from event is -1 weirdly: %+v", event)
+		lastLine = md.LineCount()
+	}
 
-	SetBufferLines(event.Buffer, newLines)
+	SetBufferMarkdown(event.Buffer, md.Edit(int(event.FirstLine), lastLine, event.LineData))
 	blockCount, ok := bufferUnblockedChannels[int(event.Buffer)]
 	if !ok {
-    blockCount = &atomic.Int32{}
+		blockCount = &atomic.Int32{}
 		bufferUnblockedChannels[int(event.Buffer)] = blockCount
 	}
 
-  blockCount.CompareAndSwap(0, 1)
-  blockCount.Add(-1)
+	blockCount.CompareAndSwap(0, 1)
+	blockCount.Add(-1)
 }
 
-func SetBufferLines(buf nvim.Buffer, lines []string) {
+// SetBufferMarkdown replaces the parsed lines of a buffer
+func SetBufferMarkdown(buf nvim.Buffer, md *Markdown) {
 	bufferLinesMutex.Lock()
 	defer bufferLinesMutex.Unlock()
-	BufferLines[int(buf)] = lines
+	BufferMarkdown[int(buf)] = md
 }
 
 func NvimSetBufferLines(v *nvim.Nvim, buf nvim.Buffer, startLine int, endLine int, lines [][]byte) error {
@@ -106,25 +105,49 @@ func NvimSetBufferLines(v *nvim.Nvim, buf nvim.Buffer, startLine int, endLine in
 	return err
 }
 
+// WaitForBufferLines waits until the initial lines of an attached buffer
+// were received. Returns false when that takes longer than timeout
+func WaitForBufferLines(buf nvim.Buffer, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		bufferLinesMutex.RLock()
+		_, ok := BufferMarkdown[int(buf)]
+		bufferLinesMutex.RUnlock()
+		if ok {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
 func GetBufferLines(buf nvim.Buffer) ([]string, bool) {
+	md, ok := GetBufferMarkdown(buf)
+	if !ok {
+		return []string{}, false
+	}
+	return md.Lines(), true
+}
+
+// GetBufferMarkdown returns the parsed lines of a buffer once the lines
+// written to it were received back
+func GetBufferMarkdown(buf nvim.Buffer) (*Markdown, bool) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Errorf("Panic: %v", r)
 			os.Exit(1)
 		}
 	}()
-  blockPtr, ok := bufferUnblockedChannels[int(buf)]
-  if ! ok {
-    log.Warnf("Trying to read from buffer that's not yet initialized")
-    return []string{}, false
-  }
-  for blockPtr.Load() != 0 {
-    time.Sleep(10 * time.Millisecond)
-  }
+	blockPtr, ok := bufferUnblockedChannels[int(buf)]
+	if !ok {
+		log.Warnf("Trying to read from buffer that's not yet initialized")
+		return nil, false
+	}
+	for blockPtr.Load() != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
 	bufferLinesMutex.RLock()
 	defer bufferLinesMutex.RUnlock()
-	lines, ok := BufferLines[int(buf)]
-	newLines := make([]string, len(lines))
-	copy(newLines, lines)
-	return newLines, ok
+	md, ok := BufferMarkdown[int(buf)]
+	return md, ok
 }
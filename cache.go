@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+)
+
+// hashIgnoredOpts are options that don't change the output of a codeblock
+var hashIgnoredOpts = []string{CbOptID, CbOptName, CbOptCache, CbOptDepends}
+
+// Hash identifies everything that decides the output of the codeblock: its
+// language, code and options, the env vars of its section and the runner
+// config
+func (cb *Codeblock) Hash(envVars map[string]string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "language %s\n", cb.Language)
+
+	optKeys := lo.Keys(cb.Opts)
+	slices.Sort(optKeys)
+	for _, key := range optKeys {
+		if slices.Contains(hashIgnoredOpts, key) {
+			continue
+		}
+		fmt.Fprintf(h, "opt %s=%s\n", key, cb.Opts[key])
+	}
+
+	envKeys := lo.Keys(envVars)
+	slices.Sort(envKeys)
+	for _, key := range envKeys {
+		fmt.Fprintf(h, "env %s=%s\n", key, envVars[key])
+	}
+
+	if rc := codeRunnerConfigs.FindRunnerConfig(cb.Language); rc != nil {
+		if err := json.NewEncoder(h).Encode(rc); err != nil {
+			log.Errorf("Couldn't hash runner config for %s: %v", cb.Language, err)
+		}
+	}
+
+	fmt.Fprintf(h, "code\n%s", cb.Text)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// IsCached returns whether the codeblock has CACHE=true and target holds the
+// output of a successful run with the same hash
+func (cb *Codeblock) IsCached(target *Codeblock, hash string) bool {
+	if cb.Opts[CbOptCache] != "true" || target == nil {
+		return false
+	}
+	return target.Opts[CbOptHash] == hash && cb.Succeeded(target)
+}
+
+// IsStale returns whether target was written by a run of the codeblock with a
+// different hash. Out blocks without a hash are never stale
+func (cb *Codeblock) IsStale(target *Codeblock, hash string) bool {
+	if target == nil || target.Opts[CbOptHash] == "" {
+		return false
+	}
+	return target.Opts[CbOptHash] != hash
+}
+
+// MarkStaleOutputs sets a status on all out blocks of the document whose
+// codeblock changed since they were written and returns them
+func MarkStaleOutputs(doc Document) ([]*Codeblock, error) {
+	md, err := doc.Markdown()
+	if err != nil {
+		return nil, err
+	}
+	codeblocks, err := md.Codeblocks(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := map[string]*Codeblock{}
+	for _, cb := range codeblocks {
+		if source, ok := cb.Opts[CbOptSource]; ok && !cb.IsStderrTarget() && !cb.IsExpectBlock() {
+			targets[source] = cb
+		}
+	}
+
+	stale := []*Codeblock{}
+	for _, cb := range codeblocks {
+		target, ok := targets[cb.Opts[CbOptID]]
+		if !ok && cb.Opts[CbOptName] != "" {
+			target, ok = targets[cb.Opts[CbOptName]]
+		}
+		if !ok || !IsRunnable(cb) {
+			continue
+		}
+		if !cb.IsStale(target, cb.Hash(md.EnvVars(cb))) {
+			continue
+		}
+		stale = append(stale, target)
+		if err := target.SetStatus(staleGlyph, highlightGroupWarn); err != nil {
+			log.Errorf("Couldn't set status on out block of %s: %v", cb.Ref(), err)
+		}
+	}
+	return stale, nil
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/mrWinston/mdrun.nvim/pkg/runner"
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+)
+
+const cliUsage = `Usage: mdrun <command> [flags] FILE.md...
+
+Commands:
+  run    run the codeblocks of the files and write their output back
+  test   run the codeblocks of the files and compare with their out blocks
+
+Run 'mdrun <command> -h' for the flags of a command.
+`
+
+// RunCli runs mdrun as a command line tool without neovim. Returns the exit
+// code of the process
+func RunCli(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+
+	switch args[0] {
+	case "run":
+		return runCommand(args[1:])
+	case "test":
+		return testCommand(args[1:])
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, cliUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n%s", args[0], cliUsage)
+		return 2
+	}
+}
+
+func runCommand(args []string) int {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	configPath := flags.String("config", "", "yaml or json config file (default: mdrun/config.yaml in the user config dir)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: mdrun run [flags] FILE.md...\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	config, err := LoadConfigFile(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		return 1
+	}
+	codeRunnerConfigs = config
+
+	exitCode := 0
+	for _, file := range flags.Args() {
+		failed, err := runFile(file)
+		if err != nil {
+			printFileError(file, err)
+			exitCode = 1
+			continue
+		}
+		if failed {
+			exitCode = 1
+		}
+	}
+
+	return exitCode
+}
+
+// IsRunnable returns whether the codeblock is run when running a whole file.
+// Out blocks, env blocks and blocks without a runner are skipped
+func IsRunnable(cb *Codeblock) bool {
+	if _, ok := cb.Opts[CbOptSource]; ok {
+		return false
+	}
+	if cb.Language == "env" {
+		return false
+	}
+	return codeRunnerConfigs.FindRunner(cb.Language) != nil
+}
+
+// runFile runs all runnable codeblocks of a markdown file and writes their
+// output back to the file. failed is true when at least one codeblock exited
+// with an error
+func runFile(file string) (failed bool, err error) {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return false, err
+	}
+	doc, err := readDocument(file)
+	if err != nil {
+		return false, err
+	}
+	defer RemoveWorkspaces(doc.ID())
+	printDuplicateIDs(file, doc)
+
+	codeblocks, err := GetCodeblocks(doc)
+	if err != nil {
+		return false, err
+	}
+	runnableCount := len(lo.Filter(codeblocks, func(cb *Codeblock, _ int) bool {
+		return IsRunnable(cb)
+	}))
+
+	for i := 0; i < runnableCount; i++ {
+		// writing output moves the following codeblocks, so they are parsed
+		// again for every run. The order of runnable blocks doesn't change
+		codeblocks, err = GetCodeblocks(doc)
+		if err != nil {
+			return failed, err
+		}
+		cb := lo.Filter(codeblocks, func(cb *Codeblock, _ int) bool {
+			return IsRunnable(cb)
+		})[i]
+
+		if _, ok := cb.Opts[CbOptSession]; ok {
+			fmt.Fprintf(os.Stderr, "%s:%d: skipping %s codeblock, sessions need neovim\n", file, cb.StartLine+1, cb.Language)
+			continue
+		}
+
+		if err := EnsureID(cb); err != nil {
+			return failed, err
+		}
+
+		hash := cb.Hash(cb.GetEnvVars())
+		target := cb.FindTarget(codeblocks, "")
+		if cb.IsCached(target, hash) {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s codeblock %s didn't change, skipping\n", file, cb.StartLine+1, cb.Language, cb.GetID())
+			continue
+		}
+
+		execution, err := ExecuteCodeblock(cb)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: error running %s codeblock: %v\n", file, cb.StartLine+1, cb.Language, err)
+			failed = true
+			continue
+		}
+		if execution.TimedOut {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s codeblock %s timed out\n", file, cb.StartLine+1, cb.Language, cb.GetID())
+		}
+		fmt.Fprintf(os.Stderr, "%s:%d: %s codeblock %s exited with %d\n", file, cb.StartLine+1, cb.Language, cb.GetID(), execution.ExitCode)
+		for _, d := range execution.Diagnostics {
+			fmt.Fprintf(os.Stderr, "%s:%d:%d: %s: %s\n", file, d.Line+1, d.Col+1, strings.ToLower(d.Severity), strings.ReplaceAll(d.Message, "\n", " "))
+		}
+
+		opts := execution.Opts()
+		opts[CbOptHash] = hash
+		err = SetTargetText(cb, execution.Output, opts)
+		if err != nil {
+			return failed, err
+		}
+		if cb.SeparateStderr() {
+			err = SetStderrTargetText(cb, execution.Stderr, execution.StderrOpts())
+			if err != nil {
+				return failed, err
+			}
+		}
+
+		codeblocks, err = GetCodeblocks(doc)
+		if err != nil {
+			return failed, err
+		}
+		failures := CheckExpectations(cb, codeblocks, execution.ExitCode, execution.Outputs())
+		if _, ok, _ := cb.ExpectedExitCode(); !ok && execution.ExitCode != 0 {
+			failed = true
+		}
+		if len(failures) > 0 {
+			failed = true
+			fmt.Fprintf(os.Stderr, "%s:%d: expectations of %s codeblock %s failed:\n%s\n", file, cb.StartLine+1, cb.Language, cb.GetID(), strings.Join(failures, "\n"))
+		}
+	}
+
+	lines, _ := doc.Lines()
+	return failed, os.WriteFile(file, []byte(strings.Join(lines, "\n")), stat.Mode())
+}
+
+// documentCount numbers the documents read by the cli, so that the
+// workspaces of different files are kept apart
+var documentCount atomic.Int32
+
+// printFileError prints an error of a file, with the line it refers to if
+// it has one
+func printFileError(file string, err error) {
+	var fenceErr *UnclosedFenceError
+	if errors.As(err, &fenceErr) {
+		fmt.Fprintf(os.Stderr, "%s:%d: %v\n", file, fenceErr.Line+1, err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+}
+
+// printDuplicateIDs gives copied codeblocks of the document new ids and
+// prints a warning for them
+func printDuplicateIDs(file string, doc Document) {
+	warnings, err := FixDuplicateIDs(doc)
+	if err != nil {
+		printFileError(file, err)
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "%s: warning: %s\n", file, warning)
+	}
+}
+
+// readDocument reads a markdown file into a document
+func readDocument(file string) (*MemoryDocument, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	doc := NewMemoryDocument(int(documentCount.Add(1)), strings.Split(string(content), "\n"))
+	absPath, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	doc.SetPath(absPath)
+	return doc, nil
+}
+
+// Execution is the outcome of a codeblock run to completion
+type Execution struct {
+	// Output is stdout, combined with stderr unless that is separated
+	Output string
+	// Stderr is the output of stderr when it's separated, see ERR=separate
+	Stderr    string
+	Separated bool
+	ExitCode  int
+	TimedOut  bool
+	// Signal is the last signal sent to stop the codeblock, 0 if it wasn't
+	// stopped
+	Signal syscall.Signal
+	// Diagnostics are the error messages in the output that point at lines
+	// of the codeblock
+	Diagnostics []Diagnostic
+	// LogFile and StderrLogFile hold the full output when Output or Stderr
+	// were truncated
+	LogFile       string
+	StderrLogFile string
+}
+
+// ExecuteCodeblock runs the codeblock to completion. It is stopped when it
+// runs longer than its timeout. The output is rendered like on a terminal
+func ExecuteCodeblock(cb *Codeblock) (*Execution, error) {
+	codeRunner := codeRunnerConfigs.FindRunner(cb.Language)
+	if codeRunner == nil {
+		return nil, fmt.Errorf("Couldn't find runner for language: %s", cb.Language)
+	}
+	timeout, err := codeRunnerConfigs.Timeout(cb)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := codeRunnerConfigs.OutputLimits(cb)
+	if err != nil {
+		return nil, err
+	}
+	normalizer, err := codeRunnerConfigs.Normalizer(cb)
+	if err != nil {
+		return nil, err
+	}
+
+	envVars, err := WorkspaceEnvVars(cb, cb.GetEnvVars())
+	if err != nil {
+		return nil, err
+	}
+	opts, err := RunnerOpts(cb, envVars)
+	if err != nil {
+		return nil, err
+	}
+	codeDir, err := runner.NewCodeDir("mdrun")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(codeDir)
+	opts[runner.RUNNER_OPT_CODE_DIR] = codeDir
+	cmd, err := codeRunner.CreateCommand(nil, cb.Text, opts, envVars)
+	if err != nil {
+		return nil, err
+	}
+
+	if cb.Opts["DOCKER"] == "true" {
+		cmd, err = WrapInContainer(cmd, cb)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ptySize, err := codeRunnerConfigs.TerminalSize(cb)
+	if err != nil {
+		return nil, err
+	}
+
+	var out, errOut bytes.Buffer
+	copied := make(chan struct{})
+	if ptySize != nil {
+		ptmx, err := startInPty(cmd, ptySize)
+		if err != nil {
+			return nil, err
+		}
+		defer ptmx.Close()
+		go func() {
+			// reading fails with EIO once the command has exited
+			_, _ = io.Copy(&out, ptmx)
+			close(copied)
+		}()
+	} else {
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		if cb.SeparateStderr() {
+			cmd.Stderr = &errOut
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		close(copied)
+	}
+
+	execution := &Execution{Separated: cmd.Stderr == &errOut}
+	exited := make(chan struct{})
+	var signalMutex sync.Mutex
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			signalMutex.Lock()
+			execution.TimedOut = true
+			signalMutex.Unlock()
+			err := stopProcessGroup(cmd.Process.Pid, codeRunnerConfigs.StopSignals(), codeRunnerConfigs.GracePeriod(), exited, func(sig syscall.Signal) {
+				signalMutex.Lock()
+				defer signalMutex.Unlock()
+				execution.Signal = sig
+			})
+			if err != nil {
+				log.Errorf("Error stopping codeblock: %v", err)
+			}
+		})
+		defer timer.Stop()
+	}
+
+	err = cmd.Wait()
+	close(exited)
+	<-copied
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil, err
+	}
+
+	signalMutex.Lock()
+	defer signalMutex.Unlock()
+	execution.Diagnostics = ParseDiagnostics(cb, codeDir, cmd.Dir, RenderTerminalOutput(out.String())+"\n"+RenderTerminalOutput(errOut.String()))
+	execution.Output, execution.LogFile, err = renderExecutionOutput(cb, "", out.String(), normalizer, limits)
+	if err != nil {
+		return nil, err
+	}
+	execution.Stderr, execution.StderrLogFile, err = renderExecutionOutput(cb, StreamStderr, errOut.String(), normalizer, limits)
+	if err != nil {
+		return nil, err
+	}
+	execution.ExitCode = cmd.ProcessState.ExitCode()
+	return execution, nil
+}
+
+// renderExecutionOutput renders the output of a stream like on a terminal,
+// normalizes it and truncates it to the limits. logFile holds the full output
+// when it was truncated
+func renderExecutionOutput(cb *Codeblock, stream string, raw string, normalizer *Normalizer, limits OutputLimits) (output string, logFile string, err error) {
+	output = RenderTerminalOutput(raw)
+	if mode := cb.Opts[CbOptAnsi]; mode == AnsiRender || mode == AnsiStrip {
+		// files can't hold highlights
+		output = StripANSI(output)
+	}
+	output = normalizer.Apply(output)
+	truncated, _, ok := limits.Truncate(output)
+	if !ok {
+		return output, "", nil
+	}
+	logFile, err = WriteOutputLog(cb, stream, output)
+	if err != nil {
+		return "", "", err
+	}
+	return truncated, logFile, nil
+}
+
+// runResultOpts are options of an out block that are only set by some runs
+var runResultOpts = []string{CbOptTimedOut, CbOptSignal, CbOptLog}
+
+// Opts returns the options recorded in the out block for this execution
+func (e *Execution) Opts() map[string]string {
+	opts := map[string]string{
+		CbOptLastRun:  time.Now().Format(time.RFC3339),
+		CbOptExitCode: fmt.Sprintf("%d", e.ExitCode),
+	}
+	setStopOpts(opts, e.TimedOut, e.Signal)
+	if e.LogFile != "" {
+		opts[CbOptLog] = e.LogFile
+	}
+	return opts
+}
+
+// Outputs returns the output of every stream, keyed by the STREAM of its out
+// block
+func (e *Execution) Outputs() map[string]string {
+	outputs := map[string]string{"": normalizeOutputText(e.Output)}
+	if e.Separated {
+		outputs[StreamStderr] = normalizeOutputText(e.Stderr)
+	}
+	return outputs
+}
+
+// StderrOpts returns the options recorded in the stderr out block for this
+// execution
+func (e *Execution) StderrOpts() map[string]string {
+	opts := map[string]string{}
+	if e.StderrLogFile != "" {
+		opts[CbOptLog] = e.StderrLogFile
+	}
+	return opts
+}
+
+// SetTargetText writes text to the out codeblock of cb. The out block is
+// created below cb if it doesn't exist yet. opts are added to the options of
+// the out block, replacing those recorded by the last run
+func SetTargetText(cb *Codeblock, text string, opts map[string]string) error {
+	return setOutputText(cb, "", text, opts)
+}
+
+// SetStderrTargetText is like SetTargetText for the out block receiving
+// stderr of cb, which is created below the out block of stdout
+func SetStderrTargetText(cb *Codeblock, text string, opts map[string]string) error {
+	return setOutputText(cb, StreamStderr, text, opts)
+}
+
+// setOutputText writes text to the out block of cb for the given stream
+func setOutputText(cb *Codeblock, stream string, text string, opts map[string]string) error {
+	codeblocks, err := GetCodeblocks(cb.Document)
+	if err != nil {
+		return err
+	}
+
+	target := cb.FindTarget(codeblocks, stream)
+	found := target != nil
+	if !found {
+		outlanguage, ok := cb.Opts["OUT"]
+		if !ok {
+			outlanguage = "out"
+		}
+		target = &Codeblock{
+			Language: outlanguage,
+			Opts: map[string]string{
+				CbOptSource: cb.GetID(),
+			},
+			Fence:    Fence{Char: cb.Fence.Char, Indent: cb.Fence.Indent},
+			Document: cb.Document,
+		}
+		if stream != "" {
+			target.Opts[CbOptStream] = stream
+		}
+	}
+
+	target.Text = text
+	for _, k := range runResultOpts {
+		delete(target.Opts, k)
+	}
+	for k, v := range opts {
+		target.Opts[k] = v
+	}
+
+	if found {
+		return cb.Document.SetLines(target.StartLine, target.EndLine+1, target.GetMarkdownLines())
+	}
+	writeLine := cb.EndLine + 1
+	if stdoutTarget := cb.FindTarget(codeblocks, ""); stdoutTarget != nil && stream != "" {
+		writeLine = stdoutTarget.EndLine + 1
+	}
+	newLines := append([][]byte{[]byte("")}, target.GetMarkdownLines()...)
+	return cb.Document.SetLines(writeLine, writeLine, newLines)
+}
@@ -1,16 +1,14 @@
 package main
 
 import (
-	"errors"
 	"fmt"
-	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/neovim/go-client/nvim"
 	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
-	ts "github.com/smacker/go-tree-sitter"
 )
 
 type Codeblock struct {
@@ -21,24 +19,74 @@ type Codeblock struct {
 	EndCol    int
 	Opts      map[string]string
 	Text      string
-	Buffer    nvim.Buffer
+	// Fence is the opening fence, which is reused when the codeblock is
+	// written
+	Fence    Fence
+	Document Document
+	// anchor is the id of the extmark that tracks the codeblock while it's
+	// running, 0 when it isn't anchored
+	anchor int
 }
 
 const ExtmarkNs = "codeblock_run"
 
+// extmarkIDsPerCodeblock is the number of extmark ids reserved for every
+// codeblock, starting at its ID. They hold the status marks of the codeblock
+// and its out blocks, its failed expectations and the anchors of the
+// codeblock and its out blocks
+const extmarkIDsPerCodeblock = 8
+
 const (
 	CbOptWorkdir             = "CWD"
 	CbOptWorkdirDockerPrefix = "docker"
 	CbOptID                  = "ID"
 	CbOptSource              = "SOURCE"
 	CbOptLastRun             = "LAST_RUN"
+	CbOptSession             = "SESSION"
+	CbOptExitCode            = "EXIT_CODE"
+	CbOptName                = "NAME"
+	CbOptDepends             = "DEPENDS"
+	CbOptTimeout             = "TIMEOUT"
+	CbOptTimedOut            = "TIMED_OUT"
+	CbOptSignal              = "SIGNAL"
+	CbOptHash                = "HASH"
+	CbOptCache               = "CACHE"
+	CbOptPty                 = "PTY"
+	CbOptPtySize             = "PTY_SIZE"
+	CbOptAnsi                = "ANSI"
+	CbOptMaxLines            = "MAX_LINES"
+	CbOptMaxBytes            = "MAX_BYTES"
+	CbOptKeep                = "KEEP"
+	CbOptLog                 = "LOG"
+	CbOptErr                 = "ERR"
+	CbOptStream              = "STREAM"
+	CbOptExpectExit          = "EXPECT_EXIT"
+	CbOptMatch               = "MATCH"
+	CbOptNormalize           = "NORMALIZE"
+	CbOptWorkspace           = "WORKSPACE"
 )
 
 var (
-	ErrNotACodeblock = errors.New("Node is not a fenced codeblock")
-	DefaultShell     = "zsh"
+	DefaultShell = "zsh"
 )
 
+var lastCodeblockID int64
+var lastCodeblockIDMutex = sync.Mutex{}
+
+// NewCodeblockID returns a new id based on the current time. Ids are unique
+// even when several are created within the same millisecond, and far enough
+// apart that their extmark ids don't overlap
+func NewCodeblockID() string {
+	lastCodeblockIDMutex.Lock()
+	defer lastCodeblockIDMutex.Unlock()
+	id := time.Now().UnixMilli()
+	if id < lastCodeblockID+extmarkIDsPerCodeblock {
+		id = lastCodeblockID + extmarkIDsPerCodeblock
+	}
+	lastCodeblockID = id
+	return fmt.Sprintf("%d", id)
+}
+
 func (cb *Codeblock) GetID() string {
 	if id, ok := cb.Opts[CbOptID]; ok {
 		return id
@@ -46,8 +94,8 @@ func (cb *Codeblock) GetID() string {
 	return cb.Opts[CbOptSource]
 }
 
-func FindCodeblockByOpt(key string, val string, buffer nvim.Buffer) (*Codeblock, error) {
-	allCodeblocks, err := GetCodeblocks(buffer)
+func FindCodeblockByOpt(key string, val string, doc Document) (*Codeblock, error) {
+	allCodeblocks, err := GetCodeblocks(doc)
 	if err != nil {
 		return nil, err
 	}
@@ -63,147 +111,97 @@ func FindCodeblockByOpt(key string, val string, buffer nvim.Buffer) (*Codeblock,
 }
 
 
-func (cb *Codeblock) Write(v *nvim.Nvim) error {
-
-	codeLines, ok := GetBufferLines(cb.Buffer)
-	if !ok {
-		return fmt.Errorf("No Buffer lines for buffer %d", cb.Buffer)
-	}
-
-	findString := ""
-	if cb.Opts[CbOptID] != "" {
-		findString = fmt.Sprintf("%s=%s", CbOptID, cb.Opts[CbOptID])
-	} else {
-		findString = fmt.Sprintf("%s=%s", CbOptSource, cb.Opts[CbOptSource])
+// Write replaces the codeblock in its document. An anchored codeblock is
+// written where its anchor is, otherwise it's looked up by its options
+func (cb *Codeblock) Write() error {
+	found, err := cb.Locate()
+	if err != nil {
+		return err
 	}
-
-	_, idx, found := lo.FindIndexOf(codeLines, func(elem string) bool {
-		return strings.Contains(elem, findString)
-	})
 	if !found {
-		return fmt.Errorf("Couldn't find codeblock in buffer lines")
-	}
-
-	cb.StartLine = idx
-	cb.EndLine = -1
-	for i := idx + 1; i < len(codeLines); i++ {
-		if codeLines[i] == "```" {
-			cb.EndLine = i
-			break
+		if err := cb.lookup(); err != nil {
+			return err
 		}
 	}
 
-	if cb.EndLine == -1 {
-		return fmt.Errorf("Cound't find endline for codeblock")
-	}
-
-	err := NvimSetBufferLines(
-		v,
-		cb.Buffer,
+	markdownLines := cb.GetMarkdownLines()
+	err = cb.Document.SetLines(
 		cb.StartLine,
 		cb.EndLine+1,
-		cb.GetMarkdownLines(),
+		markdownLines,
 	)
+	if err != nil {
+		return err
+	}
 
-	return err
+	cb.EndLine = cb.StartLine + len(markdownLines) - 1
+	// replacing all of its lines collapses the anchor
+	return cb.reanchor()
 }
 
-func (cb *Codeblock) SetStatus(v *nvim.Nvim, status string, highlight string) error {
-	namespaceID, err := v.CreateNamespace(ExtmarkNs)
+// lookup moves the codeblock to the codeblock in its document with the same
+// ID, or for out blocks the same SOURCE and STREAM
+func (cb *Codeblock) lookup() error {
+	codeblocks, err := GetCodeblocks(cb.Document)
 	if err != nil {
 		return err
 	}
+	current, found := lo.Find(codeblocks, func(other *Codeblock) bool {
+		if cb.Opts[CbOptID] != "" {
+			return other.Opts[CbOptID] == cb.Opts[CbOptID]
+		}
+		// the stdout and stderr out blocks have the same SOURCE
+		return other.Opts[CbOptSource] == cb.Opts[CbOptSource] && other.Opts[CbOptStream] == cb.Opts[CbOptStream] && !other.IsExpectBlock()
+	})
+	if !found {
+		return fmt.Errorf("Couldn't find codeblock in buffer lines")
+	}
+
+	cb.StartLine = current.StartLine
+	cb.EndLine = current.EndLine
+	cb.Fence = current.Fence
+	return nil
+}
+
+func (cb *Codeblock) SetStatus(status string, highlight string) error {
 	var extmarkID int
+	var err error
 	if cb.Opts[CbOptID] != "" {
 		extmarkID, err = strconv.Atoi(cb.Opts[CbOptID])
 	} else {
-		extmarkID, err = strconv.Atoi(cb.Opts[CbOptSource])
+		extmarkID, err = cb.sourceExtmarkID()
 		extmarkID++
+		if cb.IsStderrTarget() {
+			extmarkID++
+		}
 	}
 
 	if err != nil {
 		return err
 	}
 
-	_, err = v.SetBufferExtmark(cb.Buffer, namespaceID, cb.StartLine, 0, map[string]any{
-		"id":        extmarkID,
-		"virt_text": [][]any{{status, highlight}},
-	})
-
-	return err
+	return cb.Document.SetStatus(cb.anchoredLine(), extmarkID, status, highlight)
 }
 
-func NewCodeblockFromNode(node *ts.Node, buf nvim.Buffer, sourceLines []string) (*Codeblock, error) {
-
-	sourceCode := strings.Join(sourceLines, "\n")
-
-	if node.Type() != "fenced_code_block" {
-		return nil, ErrNotACodeblock
-	}
-
-	cb := &Codeblock{
-		StartLine: int(node.StartPoint().Row),
-		EndLine:   int(node.EndPoint().Row),
-		StartCol:  int(node.StartPoint().Column),
-		EndCol:    int(node.EndPoint().Column),
-		Text:      node.Content([]byte(sourceCode)),
-		Opts:      make(map[string]string),
-		Buffer:    buf,
-	}
-
-	if cb.EndCol == 0 {
-		// this means, we're not on the last line and the endline is one line too low
-		cb.EndLine = cb.EndLine - 1
-	}
-
-	for i := 0; i < int(node.ChildCount()); i++ {
-		currentChild := node.Child(i)
-		if currentChild == nil {
-			continue
-		}
-
-		if currentChild.Type() == "info_string" {
-			infoString := currentChild.Content([]byte(sourceCode))
-			infoSplit := strings.Split(infoString, " ")
-			if len(infoSplit) == 0 {
-				continue
-			}
-			cb.Language = infoSplit[0]
-
-			if len(infoSplit) == 1 {
-				continue
-			}
-
-			for _, v := range infoSplit[1:] {
-				keyValSplit := strings.Split(v, "=")
-				if len(keyValSplit) != 2 {
-					continue
-				}
-				cb.Opts[keyValSplit[0]] = keyValSplit[1]
-			}
-
-		} else if currentChild.Type() == "code_fence_content" {
-			cb.Text = currentChild.Content([]byte(sourceCode))
-			cb.Text = strings.TrimRight(cb.Text, "`")
-		}
-	}
-
-	lines := sourceLines[cb.StartLine+1 : cb.EndLine]
-	cb.Text = strings.Join(lines, "\n")
-	if len(lines) != 0 {
-		cb.Text = cb.Text + "\n"
+// SetHighlights replaces the highlights of the text of the codeblock. Lines
+// of the highlights are relative to the first line of the text
+func (cb *Codeblock) SetHighlights(highlights []Highlight) error {
+	shifted := make([]Highlight, 0, len(highlights))
+	for _, h := range highlights {
+		h.Line += cb.StartLine + 1
+		shifted = append(shifted, h)
 	}
-
-	return cb, nil
+	// highlights of replaced lines end up on the start line
+	return cb.Document.SetHighlights(cb.StartLine, cb.EndLine+1, shifted)
 }
 
 func (cb *Codeblock) GetEnvVars() map[string]string {
-	sourceLines, ok := GetBufferLines(cb.Buffer)
-	if !ok {
-		logrus.Errorf("Couldnnt find text for buffer %v", cb.Buffer)
+	md, err := cb.Document.Markdown()
+	if err != nil {
+		logrus.Errorf("Couldnnt find text for document %d: %v", cb.Document.ID(), err)
 		return nil
 	}
-	return GetEnvVarsForCB(cb, sourceLines)
+	return md.EnvVars(cb)
 }
 
 func (cb *Codeblock) GetMarkdownLines() [][]byte {
@@ -211,80 +209,53 @@ func (cb *Codeblock) GetMarkdownLines() [][]byte {
 
 	newLines := [][]byte{}
 
-	sb.WriteString("```")
-	sb.WriteString(cb.Language)
-
-	optionKeys := []string{}
-	for k := range cb.Opts {
-		optionKeys = append(optionKeys, k)
-	}
-	slices.SortFunc(optionKeys, func(a string, b string) int {
-		if a == CbOptID || a == CbOptSource {
-			return -1
-		}
-		if b == CbOptID || b == CbOptSource {
-			return 1
-		}
-		return strings.Compare(a, b)
-	})
-
-	for _, key := range optionKeys {
-		sb.WriteString(" ")
-		sb.WriteString(key)
-		sb.WriteString("=")
-		sb.WriteString(cb.Opts[key])
-
-	}
+	fence := cb.Fence.ForText(cb.Text)
+	sb.WriteString(fence.Indent)
+	sb.WriteString(fence.Marker())
+	sb.WriteString(ParseInfoString(cb.Fence.Info).Render(cb.Language, cb.Opts))
 	newLines = append(newLines, []byte(sb.String()))
 	sb.Reset()
-	for _, line := range strings.Split(cb.Text, "\n") {
-		newLines = append(newLines, []byte(line))
-	}
-	if len(newLines[len(newLines)-1]) == 0 {
-		newLines = newLines[:len(newLines)-1]
+	for _, line := range codeblockTextLines(cb.Text) {
+		newLines = append(newLines, []byte(fence.Indented(line)))
 	}
 
-	newLines = append(newLines, []byte("```"))
+	newLines = append(newLines, []byte(fence.Indent+fence.Marker()))
 
 	return newLines
 }
 
-func getChildNodesWithType(node *ts.Node, nodeType string) []*ts.Node {
-	children := []*ts.Node{}
-	for i := 0; i < int(node.ChildCount()); i++ {
-		currentChild := node.Child(i)
-		if currentChild == nil || currentChild.Type() != nodeType {
-			continue
-		}
-		children = append(children, currentChild)
+// codeblockTextLines splits the text of a codeblock into the lines between
+// its fences. The newline at the end of the text doesn't start another line
+func codeblockTextLines(text string) []string {
+	lines := strings.Split(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
 	}
-
-	return children
+	return lines
 }
 
-func GetCodeblocks(curBuf nvim.Buffer) ([]*Codeblock, error) {
-	sourceLines, _ := GetBufferLines(curBuf)
-	return CodeBlocksFromLines(curBuf, sourceLines)
-}
-
-func FindCodeblockUnderCursor(v *nvim.Nvim) (codeblockUnderCursor *Codeblock, err error) {
-	currentWindow, err := v.CurrentWindow()
+func GetCodeblocks(doc Document) ([]*Codeblock, error) {
+	md, err := doc.Markdown()
 	if err != nil {
 		return nil, err
 	}
-	currentBuffer, err := v.CurrentBuffer()
+	return md.Codeblocks(doc)
+}
+
+func FindCodeblockUnderCursor(e Editor) (codeblockUnderCursor *Codeblock, err error) {
+	currentDocument, err := e.CurrentDocument()
 	if err != nil {
 		return nil, err
 	}
-	codeblocks, err := GetCodeblocks(currentBuffer)
+	codeblocks, err := GetCodeblocks(currentDocument)
 	if err != nil {
 		return nil, err
 	}
 
-	cursorPosition, err := v.WindowCursor(currentWindow)
+	cursorLine, err := e.CursorLine()
 
 	for _, cb := range codeblocks {
-		if cb.StartLine < cursorPosition[0] && cb.EndLine >= cursorPosition[0] {
+		if cb.StartLine <= cursorLine && cb.EndLine > cursorLine {
 			codeblockUnderCursor = cb
 			break
 		}
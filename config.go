@@ -3,24 +3,194 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/mrWinston/mdrun.nvim/pkg/runner"
+	"github.com/samber/lo"
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 )
 
 //go:generate gomodifytags -file ./config.go -all -add-tags "json,yaml" -transform snakecase -override -w -quiet
 type RunnerConfig struct {
-	Type      string                 `json:"type" yaml:"type"`
-	Languages []string               `json:"languages" yaml:"languages"`
-	Image     string                 `json:"image" yaml:"image"`
-	Config    runner.CodeblockRunner `json:"config" yaml:"config"`
+	Type        string                 `json:"type" yaml:"type"`
+	Languages   []string               `json:"languages" yaml:"languages"`
+	Image       string                 `json:"image" yaml:"image"`
+	Pty         bool                   `json:"pty" yaml:"pty"`
+	ErrorFormat string                 `json:"error_format" yaml:"error_format"`
+	Config      runner.CodeblockRunner `json:"config" yaml:"config"`
 }
 
 type Config struct {
-	StopSignal    string                   `json:"stop_signal" yaml:"stop_signal"`
-	DockerRuntime string                   `json:"docker_runtime" yaml:"docker_runtime"`
-	RunnerConfigs map[string]*RunnerConfig `json:"runner_configs" yaml:"runner_configs"`
-	SocketDir     string                   `json:"socket_dir" yaml:"socket_dir"`
+	StopSignal      string                     `json:"stop_signal" yaml:"stop_signal"`
+	StopGracePeriod string                     `json:"stop_grace_period" yaml:"stop_grace_period"`
+	DefaultTimeout  string                     `json:"default_timeout" yaml:"default_timeout"`
+	PtySize         string                     `json:"pty_size" yaml:"pty_size"`
+	FlushInterval   string                     `json:"flush_interval" yaml:"flush_interval"`
+	MaxLines        int                        `json:"max_lines" yaml:"max_lines"`
+	MaxBytes        int                        `json:"max_bytes" yaml:"max_bytes"`
+	LogDir          string                     `json:"log_dir" yaml:"log_dir"`
+	Normalize       []NormalizeRule            `json:"normalize" yaml:"normalize"`
+	NormalizeRules  map[string][]NormalizeRule `json:"normalize_rules" yaml:"normalize_rules"`
+	DockerRuntime   string                     `json:"docker_runtime" yaml:"docker_runtime"`
+	RunnerConfigs   map[string]*RunnerConfig   `json:"runner_configs" yaml:"runner_configs"`
+	SocketDir       string                     `json:"socket_dir" yaml:"socket_dir"`
+	WorkspaceDir    string                     `json:"workspace_dir" yaml:"workspace_dir"`
+	KeepWorkspaces  bool                       `json:"keep_workspaces" yaml:"keep_workspaces"`
+}
+
+// DefaultStopGracePeriod is how long a codeblock gets to exit after a signal
+// before a stronger one is sent
+const DefaultStopGracePeriod = 3 * time.Second
+
+// StopSignals returns the signals sent one after the other to stop a
+// codeblock: the configured stop signal first, then the stronger ones of
+// SIGINT, SIGTERM and SIGKILL
+func (c *Config) StopSignals() []syscall.Signal {
+	if c.StopSignal == "" {
+		return stopSignalLadder
+	}
+	first, err := ParseSignal(c.StopSignal)
+	if err != nil {
+		log.Errorf("Invalid stop_signal, using SIGINT: %v", err)
+		return stopSignalLadder
+	}
+
+	idx := slices.Index(stopSignalLadder, first)
+	if idx != -1 {
+		return stopSignalLadder[idx:]
+	}
+	return append([]syscall.Signal{first}, stopSignalLadder[1:]...)
+}
+
+// GracePeriod returns the configured stop_grace_period
+func (c *Config) GracePeriod() time.Duration {
+	if c.StopGracePeriod == "" {
+		return DefaultStopGracePeriod
+	}
+	d, err := time.ParseDuration(c.StopGracePeriod)
+	if err != nil {
+		log.Errorf("Invalid stop_grace_period, using %s: %v", DefaultStopGracePeriod, err)
+		return DefaultStopGracePeriod
+	}
+	return d
+}
+
+// DefaultFlushInterval is how often new output is written to the out block
+// while a codeblock is running
+const DefaultFlushInterval = 100 * time.Millisecond
+
+// OutputFlushInterval returns the configured flush_interval. New output is
+// written right away when it's 0
+func (c *Config) OutputFlushInterval() time.Duration {
+	if c.FlushInterval == "" {
+		return DefaultFlushInterval
+	}
+	d, err := time.ParseDuration(c.FlushInterval)
+	if err != nil {
+		log.Errorf("Invalid flush_interval, using %s: %v", DefaultFlushInterval, err)
+		return DefaultFlushInterval
+	}
+	return d
+}
+
+// Timeout returns how long the codeblock may run before it is stopped, taken
+// from its TIMEOUT option or the configured default_timeout. 0 means it can
+// run forever
+func (c *Config) Timeout(cb *Codeblock) (time.Duration, error) {
+	timeout, ok := cb.Opts[CbOptTimeout]
+	if !ok {
+		timeout = c.DefaultTimeout
+	}
+	if timeout == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid timeout '%s': %w", timeout, err)
+	}
+	return d, nil
+}
+
+// FindRunner returns the runner configured for the given language, or nil if
+// there is none
+func (c *Config) FindRunner(language string) runner.CodeblockRunner {
+	if rc := c.FindRunnerConfig(language); rc != nil {
+		return rc.Config
+	}
+	return nil
+}
+
+// FindRunnerConfig returns the runner config for the given language, or nil
+// if there is none
+func (c *Config) FindRunnerConfig(language string) *RunnerConfig {
+	for _, rc := range c.RunnerConfigs {
+		if lo.Contains(rc.Languages, language) {
+			return rc
+		}
+	}
+	return nil
+}
+
+// DefaultConfigPaths returns the paths that are searched for a config file
+// when none is given on the command line
+func DefaultConfigPaths() []string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return []string{}
+	}
+	return []string{
+		path.Join(configDir, "mdrun", "config.yaml"),
+		path.Join(configDir, "mdrun", "config.yml"),
+		path.Join(configDir, "mdrun", "config.json"),
+	}
+}
+
+// LoadConfigFile reads the config from a yaml or json file. When configPath is
+// empty, the first existing file of DefaultConfigPaths is used
+func LoadConfigFile(configPath string) (*Config, error) {
+	if configPath == "" {
+		var ok bool
+		configPath, ok = lo.Find(DefaultConfigPaths(), func(p string) bool {
+			_, err := os.Stat(p)
+			return err == nil
+		})
+		if !ok {
+			return nil, fmt.Errorf("No config file given and none found in %s", strings.Join(DefaultConfigPaths(), ", "))
+		}
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if path.Ext(configPath) != ".json" {
+		// the runner configs only know how to unmarshal from json, so yaml is
+		// converted first
+		var raw map[string]any
+		err = yaml.Unmarshal(data, &raw)
+		if err != nil {
+			return nil, fmt.Errorf("Can't parse config file %s: %w", configPath, err)
+		}
+		data, err = json.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	config := &Config{}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("Can't parse config file %s: %w", configPath, err)
+	}
+
+	return config, nil
 }
 
 func (rc *RunnerConfig) UnmarshalJSON(data []byte) error {
@@ -68,6 +238,22 @@ func (rc *RunnerConfig) UnmarshalJSON(data []byte) error {
 		}
 	}
 
+	var usePty bool
+	if ptyRaw, ok := rawMap["pty"]; ok {
+		err = json.Unmarshal(ptyRaw, &usePty)
+		if err != nil {
+			return fmt.Errorf("Can't parse pty into bool")
+		}
+	}
+
+	var errorFormat string
+	if errorFormatRaw, ok := rawMap["error_format"]; ok {
+		err = json.Unmarshal(errorFormatRaw, &errorFormat)
+		if err != nil {
+			return fmt.Errorf("Can't parse error_format into string")
+		}
+	}
+
 	configRaw, ok := rawMap["config"]
 	if !ok {
 		return fmt.Errorf("Runner config needs key 'config' to be set")
@@ -112,6 +298,8 @@ func (rc *RunnerConfig) UnmarshalJSON(data []byte) error {
 	rc.Languages = languages
 	rc.Config = parsedRunner
 	rc.Image = image
+	rc.Pty = usePty
+	rc.ErrorFormat = errorFormat
 
 	return nil
 }
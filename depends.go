@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	depVisiting = iota + 1
+	depVisited
+)
+
+// FindCodeblockByRef returns the codeblock with the given ID or NAME
+func FindCodeblockByRef(ref string, doc Document) (*Codeblock, error) {
+	cb, err := FindCodeblockByOpt(CbOptID, ref, doc)
+	if err != nil {
+		return nil, err
+	}
+	if cb != nil {
+		return cb, nil
+	}
+
+	cb, err = FindCodeblockByOpt(CbOptName, ref, doc)
+	if err != nil {
+		return nil, err
+	}
+	if cb == nil {
+		return nil, fmt.Errorf("No codeblock with ID or NAME '%s'", ref)
+	}
+	return cb, nil
+}
+
+// Ref returns how the codeblock is referred to in messages
+func (cb *Codeblock) Ref() string {
+	if name := cb.Opts[CbOptName]; name != "" {
+		return name
+	}
+	if id := cb.GetID(); id != "" {
+		return id
+	}
+	return fmt.Sprintf("line %d", cb.StartLine+1)
+}
+
+// Dependencies returns the references listed in the DEPENDS option
+func (cb *Codeblock) Dependencies() []string {
+	return lo.Compact(lo.Map(strings.Split(cb.Opts[CbOptDepends], ","), func(ref string, _ int) string {
+		return strings.TrimSpace(ref)
+	}))
+}
+
+// ResolveDependencies returns the codeblock and all its direct and indirect
+// dependencies, ordered so that every codeblock comes after its dependencies.
+// cb is always the last element. Returns an error for cycles and unknown
+// references
+func ResolveDependencies(cb *Codeblock) ([]*Codeblock, error) {
+	order := []*Codeblock{}
+	// codeblocks are identified by their start line, as they don't all have ids
+	state := map[int]int{}
+
+	var visit func(current *Codeblock, path []string) error
+	visit = func(current *Codeblock, path []string) error {
+		path = append(path, current.Ref())
+		switch state[current.StartLine] {
+		case depVisiting:
+			return fmt.Errorf("Dependency cycle: %s", strings.Join(path, " -> "))
+		case depVisited:
+			return nil
+		}
+
+		state[current.StartLine] = depVisiting
+		for _, ref := range current.Dependencies() {
+			dep, err := FindCodeblockByRef(ref, current.Document)
+			if err != nil {
+				return fmt.Errorf("Dependency of %s: %w", current.Ref(), err)
+			}
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+		state[current.StartLine] = depVisited
+		order = append(order, current)
+		return nil
+	}
+
+	return order, visit(cb, []string{})
+}
+
+// IsOutOfDate returns whether the codeblock needs to run before codeblocks
+// depending on it can run. That's the case when it hasn't run successfully
+// yet, when it changed since, or when the session holding its state is gone
+func (cb *Codeblock) IsOutOfDate() bool {
+	if cb.GetID() == "" {
+		return true
+	}
+	if _, ok := cb.Opts[CbOptSession]; ok {
+		if _, running := GetSession(SessionID(cb)); !running {
+			return true
+		}
+	}
+
+	target, err := cb.GetTargetCodeblock()
+	if err != nil || target == nil {
+		return true
+	}
+	return !cb.Succeeded(target) || cb.IsStale(target, cb.Hash(cb.GetEnvVars()))
+}
+
+// RunWithDependencies runs the out of date dependencies of the codeblock one
+// after the other and then starts the codeblock itself. Stops at the first
+// dependency that fails. The returned channel receives the result of cb
+func RunWithDependencies(e Editor, cb *Codeblock) (<-chan error, error) {
+	if len(cb.Dependencies()) == 0 {
+		return StartCodeblock(e, cb)
+	}
+
+	order, err := ResolveDependencies(cb)
+	if err != nil {
+		return nil, err
+	}
+
+	// running a codeblock can create out blocks and move the codeblocks below
+	// it, so they are looked up again by id before they run. Adding an id
+	// doesn't move anything
+	ids := []string{}
+	for _, current := range order {
+		if err := EnsureID(current); err != nil {
+			return nil, err
+		}
+		ids = append(ids, current.GetID())
+	}
+
+	for _, id := range ids[:len(ids)-1] {
+		dep, err := FindCodeblockByOpt(CbOptID, id, cb.Document)
+		if err != nil || dep == nil {
+			return nil, fmt.Errorf("Lost dependency %s: %v", id, err)
+		}
+		if !dep.IsOutOfDate() {
+			log.Debugf("Dependency %s is up to date", dep.Ref())
+			continue
+		}
+
+		log.Infof("Running dependency %s of %s", dep.Ref(), cb.Ref())
+		done, err := StartCodeblock(e, dep)
+		if err == nil {
+			err = <-done
+		}
+		if err != nil {
+			cb.failDependency()
+			return nil, fmt.Errorf("Dependency %s of %s failed: %w", dep.Ref(), cb.Ref(), err)
+		}
+	}
+
+	current, err := FindCodeblockByOpt(CbOptID, ids[len(ids)-1], cb.Document)
+	if err != nil || current == nil {
+		return nil, fmt.Errorf("Lost codeblock %s: %v", cb.Ref(), err)
+	}
+	return StartCodeblock(e, current)
+}
+
+// failDependency marks the codeblock as failed because one of its
+// dependencies failed
+func (cb *Codeblock) failDependency() {
+	current, err := FindCodeblockByOpt(CbOptID, cb.GetID(), cb.Document)
+	if err != nil || current == nil {
+		return
+	}
+	if err := current.SetStatus(errorGlyph, highlightGroupError); err != nil {
+		log.Errorf("Couldn't set status on codeblock %s: %v", cb.Ref(), err)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mrWinston/mdrun.nvim/pkg/runner"
+	log "github.com/sirupsen/logrus"
+)
+
+// DiagnosticNs is the namespace diagnostics are published in
+const DiagnosticNs = "mdrun"
+
+const (
+	SeverityError = "ERROR"
+	SeverityWarn  = "WARN"
+	SeverityInfo  = "INFO"
+)
+
+// Diagnostic is an error message pointing at a line of a document. Line and
+// Col are zero based, Severity is one of the names of vim.diagnostic.severity
+type Diagnostic struct {
+	Line     int
+	Col      int
+	Severity string
+	Message  string
+}
+
+// fileDiagnostic is an error message as printed by a compiler or interpreter.
+// Line and Col are one based, Col is 0 when it isn't known
+type fileDiagnostic struct {
+	File     string
+	Line     int
+	Col      int
+	Severity string
+	Message  string
+}
+
+// errorFormat parses the error messages in the output of a compiler or
+// interpreter
+type errorFormat func(output string) []fileDiagnostic
+
+// errorFormats are the known error formats, keyed by the name used for the
+// error_format of a runner config
+var errorFormats = map[string]errorFormat{
+	"gcc":    parseGccErrors,
+	"go":     parseGoErrors,
+	"rustc":  parseRustcErrors,
+	"python": parsePythonErrors,
+	"ghc":    parseGhcErrors,
+}
+
+// errorFormatsByExt is the error format used for source files with the given
+// extension when the runner config doesn't set one
+var errorFormatsByExt = map[string]string{
+	".c":   "gcc",
+	".h":   "gcc",
+	".cc":  "gcc",
+	".cpp": "gcc",
+	".cxx": "gcc",
+	".hpp": "gcc",
+	".go":  "go",
+	".rs":  "rustc",
+	".py":  "python",
+	".hs":  "ghc",
+}
+
+// ParseDiagnostics finds the error messages in the output of the codeblock
+// that refer to the file its code was written to in codeDir, and maps them to
+// the lines of the codeblock in its document. Relative paths are relative to
+// either workdir, where the command ran, or codeDir, where compilers run
+func ParseDiagnostics(cb *Codeblock, codeDir string, workdir string, output string) []Diagnostic {
+	diagnostics := []Diagnostic{}
+	if codeDir == "" {
+		return diagnostics
+	}
+	rc := codeRunnerConfigs.FindRunnerConfig(cb.Language)
+	if rc == nil {
+		return diagnostics
+	}
+	sourceRunner, ok := rc.Config.(runner.SourceFileRunner)
+	if !ok {
+		return diagnostics
+	}
+	fileName := sourceRunner.SourceFileName()
+
+	formatName := rc.ErrorFormat
+	if formatName == "" {
+		formatName = errorFormatsByExt[path.Ext(fileName)]
+	}
+	format, ok := errorFormats[formatName]
+	if !ok {
+		if rc.ErrorFormat != "" {
+			log.Errorf("Unknown error_format '%s' for %s", rc.ErrorFormat, cb.Language)
+		}
+		return diagnostics
+	}
+
+	sourcePath := path.Join(codeDir, fileName)
+	lineCount := len(codeblockTextLines(cb.Text))
+	for _, d := range format(StripANSI(output)) {
+		if !isSourcePath(d.File, sourcePath, codeDir, workdir) || d.Line < 1 || d.Line > lineCount {
+			continue
+		}
+		col := 0
+		if d.Col > 0 {
+			// lines of indented codeblocks start with the indentation of
+			// the fence
+			col = d.Col - 1 + len(cb.Fence.Indent)
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			// the first line of the file is the one after the fence
+			Line:     cb.StartLine + d.Line,
+			Col:      col,
+			Severity: d.Severity,
+			Message:  d.Message,
+		})
+	}
+	return diagnostics
+}
+
+// isSourcePath returns whether file is sourcePath. A relative file is
+// resolved against each of dirs
+func isSourcePath(file string, sourcePath string, dirs ...string) bool {
+	if path.IsAbs(file) {
+		return path.Clean(file) == sourcePath
+	}
+	for _, dir := range dirs {
+		if dir != "" && path.Join(dir, file) == sourcePath {
+			return true
+		}
+	}
+	return false
+}
+
+// PublishDiagnostics replaces the diagnostics of the codeblock with the error
+// messages found in its output, see ParseDiagnostics. The codeblock is found
+// by its anchor, or looked up again, as its position may have changed while
+// it was running
+func PublishDiagnostics(cb *Codeblock, codeDir string, workdir string, output string) {
+	current := cb
+	if found, err := cb.Locate(); err != nil || !found {
+		current, err = FindCodeblockByOpt(CbOptID, cb.GetID(), cb.Document)
+		if err != nil || current == nil {
+			log.Errorf("Couldn't find codeblock %s to publish diagnostics: %v", cb.Ref(), err)
+			return
+		}
+	}
+	if err := current.Document.SetDiagnostics(current.GetID(), ParseDiagnostics(current, codeDir, workdir, output)); err != nil {
+		log.Errorf("Couldn't publish diagnostics of %s: %v", cb.Ref(), err)
+	}
+}
+
+// clearDiagnostics removes the diagnostics of the codeblock
+func clearDiagnostics(cb *Codeblock) {
+	if err := cb.Document.SetDiagnostics(cb.GetID(), nil); err != nil {
+		log.Errorf("Couldn't clear diagnostics of %s: %v", cb.Ref(), err)
+	}
+}
+
+// atoi is strconv.Atoi for strings that matched \d+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// gccError matches e.g. "main.c:3:5: error: expected ';'". The column is
+// missing for some errors of the linker and preprocessor
+var gccError = regexp.MustCompile(`(?m)^(\S+?):(\d+):(?:(\d+):)? (fatal error|error|warning|note): (.*)$`)
+
+func parseGccErrors(output string) []fileDiagnostic {
+	diagnostics := []fileDiagnostic{}
+	for _, m := range gccError.FindAllStringSubmatch(output, -1) {
+		severity := SeverityError
+		switch m[4] {
+		case "warning":
+			severity = SeverityWarn
+		case "note":
+			severity = SeverityInfo
+		}
+		diagnostics = append(diagnostics, fileDiagnostic{
+			File:     m[1],
+			Line:     atoi(m[2]),
+			Col:      atoi(m[3]),
+			Severity: severity,
+			Message:  m[5],
+		})
+	}
+	return diagnostics
+}
+
+var (
+	// goError matches compile and vet errors like
+	// "./main.go:5:2: undefined: x"
+	goError = regexp.MustCompile(`(?m)^(\S+?\.go):(\d+):(\d+): (.*)$`)
+	// goPanic matches the first line of a panic and goPanicFrame the file
+	// and line of a frame of its stack trace
+	goPanic      = regexp.MustCompile(`(?m)^panic: (.*)$`)
+	goPanicFrame = regexp.MustCompile(`(?m)^\t(\S+?\.go):(\d+)(?: \+0x[0-9a-f]+)?$`)
+)
+
+func parseGoErrors(output string) []fileDiagnostic {
+	diagnostics := []fileDiagnostic{}
+	for _, m := range goError.FindAllStringSubmatch(output, -1) {
+		diagnostics = append(diagnostics, fileDiagnostic{
+			File:     m[1],
+			Line:     atoi(m[2]),
+			Col:      atoi(m[3]),
+			Severity: SeverityError,
+			Message:  m[4],
+		})
+	}
+
+	// every frame of the stack trace gets the panic, the innermost one is
+	// usually the interesting one, but it can be in the runtime
+	panicMatch := goPanic.FindStringSubmatchIndex(output)
+	if panicMatch == nil {
+		return diagnostics
+	}
+	message := "panic: " + output[panicMatch[2]:panicMatch[3]]
+	for _, m := range goPanicFrame.FindAllStringSubmatch(output[panicMatch[1]:], -1) {
+		diagnostics = append(diagnostics, fileDiagnostic{
+			File:     m[1],
+			Line:     atoi(m[2]),
+			Severity: SeverityError,
+			Message:  message,
+		})
+	}
+	return diagnostics
+}
+
+var (
+	// rustcError matches a message and the location on the line after it:
+	//   error[E0425]: cannot find value `y` in this scope
+	//    --> main.rs:3:20
+	rustcError = regexp.MustCompile(`(?m)^(error|warning)(?:\[\w+\])?: (.*)\n\s*--> (\S+?):(\d+):(\d+)`)
+	// rustPanic matches panics like
+	//   thread 'main' panicked at main.rs:2:5:
+	//   attempt to divide by zero
+	// and the older format thread 'main' panicked at 'message', main.rs:2:5
+	rustPanic    = regexp.MustCompile(`(?m)^thread '.*' panicked at (\S+?):(\d+):(\d+):\n(.*)$`)
+	rustOldPanic = regexp.MustCompile(`(?m)^thread '.*' panicked at '(.*)', (\S+?):(\d+):(\d+)$`)
+)
+
+func parseRustcErrors(output string) []fileDiagnostic {
+	diagnostics := []fileDiagnostic{}
+	for _, m := range rustcError.FindAllStringSubmatch(output, -1) {
+		severity := SeverityError
+		if m[1] == "warning" {
+			severity = SeverityWarn
+		}
+		diagnostics = append(diagnostics, fileDiagnostic{
+			File:     m[3],
+			Line:     atoi(m[4]),
+			Col:      atoi(m[5]),
+			Severity: severity,
+			Message:  m[2],
+		})
+	}
+	for _, m := range rustPanic.FindAllStringSubmatch(output, -1) {
+		diagnostics = append(diagnostics, fileDiagnostic{
+			File:     m[1],
+			Line:     atoi(m[2]),
+			Col:      atoi(m[3]),
+			Severity: SeverityError,
+			Message:  "panicked: " + m[4],
+		})
+	}
+	for _, m := range rustOldPanic.FindAllStringSubmatch(output, -1) {
+		diagnostics = append(diagnostics, fileDiagnostic{
+			File:     m[2],
+			Line:     atoi(m[3]),
+			Col:      atoi(m[4]),
+			Severity: SeverityError,
+			Message:  "panicked: " + m[1],
+		})
+	}
+	return diagnostics
+}
+
+var (
+	// pythonFrame matches a frame of a traceback, or the location of a
+	// syntax error: File "/tmp/mdrun123/main.py", line 3, in <module>
+	pythonFrame = regexp.MustCompile(`^\s+File "(.+)", line (\d+)`)
+	// pythonWarning matches warnings like
+	// main.py:3: DeprecationWarning: invalid escape sequence
+	pythonWarning = regexp.MustCompile(`^(\S+?):(\d+): (\w*Warning): (.*)$`)
+)
+
+func parsePythonErrors(output string) []fileDiagnostic {
+	diagnostics := []fileDiagnostic{}
+	// frames of the current traceback, the exception is on the first line
+	// after it that isn't indented
+	frames := []fileDiagnostic{}
+	for _, line := range strings.Split(output, "\n") {
+		if m := pythonFrame.FindStringSubmatch(line); m != nil {
+			frames = append(frames, fileDiagnostic{
+				File:     m[1],
+				Line:     atoi(m[2]),
+				Severity: SeverityError,
+			})
+			continue
+		}
+		if m := pythonWarning.FindStringSubmatch(line); m != nil {
+			diagnostics = append(diagnostics, fileDiagnostic{
+				File:     m[1],
+				Line:     atoi(m[2]),
+				Severity: SeverityWarn,
+				Message:  m[3] + ": " + m[4],
+			})
+			continue
+		}
+		if len(frames) == 0 || line == "" || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		if strings.HasPrefix(line, "Traceback ") {
+			// a chained exception starts a new traceback
+			frames = frames[:0]
+			continue
+		}
+		for _, frame := range frames {
+			frame.Message = line
+			diagnostics = append(diagnostics, frame)
+		}
+		frames = frames[:0]
+	}
+	return diagnostics
+}
+
+var (
+	// ghcError matches the first line of a message, which is followed by
+	// its indented text:
+	//   main.hs:3:8: error: [GHC-88464]
+	//       Variable not in scope: foo :: IO ()
+	// Spans look like main.hs:3:8-10 or main.hs:(3,1)-(4,5)
+	ghcError = regexp.MustCompile(`^(\S+?\.l?hs):(?:(\d+):(\d+)(?:-\d+)?|\((\d+),(\d+)\)-\(\d+,\d+\)): (error|warning)(.*)$`)
+	// ghcCodeSnippet matches the lines quoting the code below a message
+	ghcCodeSnippet = regexp.MustCompile(`^\s*\d*\s*\|`)
+)
+
+func parseGhcErrors(output string) []fileDiagnostic {
+	diagnostics := []fileDiagnostic{}
+	lines := strings.Split(output, "\n")
+	for i := 0; i < len(lines); i++ {
+		m := ghcError.FindStringSubmatch(lines[i])
+		if m == nil {
+			continue
+		}
+		d := fileDiagnostic{
+			File:     m[1],
+			Line:     atoi(m[2]),
+			Col:      atoi(m[3]),
+			Severity: SeverityError,
+		}
+		if m[4] != "" {
+			d.Line, d.Col = atoi(m[4]), atoi(m[5])
+		}
+		if m[6] == "warning" {
+			d.Severity = SeverityWarn
+		}
+
+		// the rest of the line holds the error code, if anything
+		message := []string{}
+		if rest := strings.TrimSpace(strings.TrimPrefix(m[7], ":")); rest != "" && !strings.HasPrefix(rest, "[") {
+			message = append(message, rest)
+		}
+		for i+1 < len(lines) && strings.HasPrefix(lines[i+1], " ") && !ghcCodeSnippet.MatchString(lines[i+1]) {
+			i++
+			message = append(message, strings.TrimLeft(strings.TrimSpace(lines[i]), "• "))
+		}
+		d.Message = strings.Join(message, "\n")
+		diagnostics = append(diagnostics, d)
+	}
+	return diagnostics
+}
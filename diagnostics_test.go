@@ -0,0 +1,182 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mrWinston/mdrun.nvim/pkg/runner"
+)
+
+func TestErrorFormats(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		output string
+		want   []fileDiagnostic
+	}{
+		{
+			name:   "gcc",
+			format: "gcc",
+			output: "./main.c: In function 'main':\n./main.c:4:3: error: expected ';' before 'printf'\n    4 |   printf(\"%d\", x)\n./main.c:2:10: warning: unused variable 'y'\nmain.c:7: note: declared here\n",
+			want: []fileDiagnostic{
+				{File: "./main.c", Line: 4, Col: 3, Severity: SeverityError, Message: "expected ';' before 'printf'"},
+				{File: "./main.c", Line: 2, Col: 10, Severity: SeverityWarn, Message: "unused variable 'y'"},
+				{File: "main.c", Line: 7, Col: 0, Severity: SeverityInfo, Message: "declared here"},
+			},
+		},
+		{
+			name:   "go compile error",
+			format: "go",
+			output: "# command-line-arguments\n./main.go:5:2: undefined: x\n",
+			want: []fileDiagnostic{
+				{File: "./main.go", Line: 5, Col: 2, Severity: SeverityError, Message: "undefined: x"},
+			},
+		},
+		{
+			name:   "go panic",
+			format: "go",
+			output: "panic: runtime error: index out of range [5] with length 0\n\ngoroutine 1 [running]:\nmain.main()\n\t/tmp/x/main.go:5 +0x1d\nexit status 2\n",
+			want: []fileDiagnostic{
+				{File: "/tmp/x/main.go", Line: 5, Severity: SeverityError, Message: "panic: runtime error: index out of range [5] with length 0"},
+			},
+		},
+		{
+			name:   "rustc",
+			format: "rustc",
+			output: "error[E0425]: cannot find value `y` in this scope\n --> main.rs:3:20\n  |\nwarning: unused variable: `a`\n --> main.rs:2:9\n",
+			want: []fileDiagnostic{
+				{File: "main.rs", Line: 3, Col: 20, Severity: SeverityError, Message: "cannot find value `y` in this scope"},
+				{File: "main.rs", Line: 2, Col: 9, Severity: SeverityWarn, Message: "unused variable: `a`"},
+			},
+		},
+		{
+			name:   "rust panic",
+			format: "rustc",
+			output: "thread 'main' panicked at main.rs:2:5:\nattempt to divide by zero\nthread 'main' panicked at 'boom', src/main.rs:7:9\n",
+			want: []fileDiagnostic{
+				{File: "main.rs", Line: 2, Col: 5, Severity: SeverityError, Message: "panicked: attempt to divide by zero"},
+				{File: "src/main.rs", Line: 7, Col: 9, Severity: SeverityError, Message: "panicked: boom"},
+			},
+		},
+		{
+			name:   "python traceback",
+			format: "python",
+			output: "Traceback (most recent call last):\n  File \"/tmp/x/main.py\", line 3, in <module>\n    f()\n  File \"/tmp/x/main.py\", line 2, in f\n    return 1/0\nZeroDivisionError: division by zero\n",
+			want: []fileDiagnostic{
+				{File: "/tmp/x/main.py", Line: 3, Severity: SeverityError, Message: "ZeroDivisionError: division by zero"},
+				{File: "/tmp/x/main.py", Line: 2, Severity: SeverityError, Message: "ZeroDivisionError: division by zero"},
+			},
+		},
+		{
+			name:   "python chained exception",
+			format: "python",
+			output: "Traceback (most recent call last):\n  File \"main.py\", line 2, in <module>\nKeyError: 'a'\n\nDuring handling of the above exception, another exception occurred:\n\nTraceback (most recent call last):\n  File \"main.py\", line 4, in <module>\nValueError: b\n",
+			want: []fileDiagnostic{
+				{File: "main.py", Line: 2, Severity: SeverityError, Message: "KeyError: 'a'"},
+				{File: "main.py", Line: 4, Severity: SeverityError, Message: "ValueError: b"},
+			},
+		},
+		{
+			name:   "python warning",
+			format: "python",
+			output: "main.py:3: DeprecationWarning: invalid escape sequence '\\d'\n",
+			want: []fileDiagnostic{
+				{File: "main.py", Line: 3, Severity: SeverityWarn, Message: "DeprecationWarning: invalid escape sequence '\\d'"},
+			},
+		},
+		{
+			name:   "ghc",
+			format: "ghc",
+			output: "main.hs:3:8: error: [GHC-88464]\n    Variable not in scope: foo :: IO ()\n  |\n3 | main = foo\n  |        ^^^\nmain.hs:(5,1)-(6,3): warning: [-Wunused-top-binds]\n    Defined but not used: `bar'\n",
+			want: []fileDiagnostic{
+				{File: "main.hs", Line: 3, Col: 8, Severity: SeverityError, Message: "Variable not in scope: foo :: IO ()"},
+				{File: "main.hs", Line: 5, Col: 1, Severity: SeverityWarn, Message: "Defined but not used: `bar'"},
+			},
+		},
+		{"no errors", "gcc", "hello\n", []fileDiagnostic{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := errorFormats[tt.format](tt.output)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDiagnostics(t *testing.T) {
+	defer func(config *Config) { codeRunnerConfigs = config }(codeRunnerConfigs)
+	codeRunnerConfigs = &Config{RunnerConfigs: map[string]*RunnerConfig{
+		"python": {Languages: []string{"python"}, Config: &runner.InterpretedRunner{Interpreter: "python3", FileName: "main.py"}},
+		"c":      {Languages: []string{"c"}, Config: &runner.CompiledRunner{Compiler: "gcc", FileName: "main.c"}},
+	}}
+
+	tests := []struct {
+		name     string
+		language string
+		indent   string
+		output   string
+		want     []Diagnostic
+	}{
+		{
+			name:     "absolute path in code dir",
+			language: "python",
+			output:   "Traceback (most recent call last):\n  File \"/code/main.py\", line 2, in <module>\nNameError: x\n",
+			want:     []Diagnostic{{Line: 12, Severity: SeverityError, Message: "NameError: x"}},
+		},
+		{
+			name:     "file with the same name elsewhere",
+			language: "python",
+			output:   "Traceback (most recent call last):\n  File \"/work/main.py\", line 2, in <module>\nNameError: x\n",
+			want:     []Diagnostic{},
+		},
+		{
+			name:     "relative to code dir",
+			language: "c",
+			output:   "./main.c:3:5: error: expected ';'\n",
+			want:     []Diagnostic{{Line: 13, Col: 4, Severity: SeverityError, Message: "expected ';'"}},
+		},
+		{
+			name:     "relative to workdir",
+			language: "c",
+			output:   "../code/main.c:3:5: error: expected ';'\n",
+			want:     []Diagnostic{{Line: 13, Col: 4, Severity: SeverityError, Message: "expected ';'"}},
+		},
+		{
+			name:     "indented codeblock",
+			language: "c",
+			indent:   "  ",
+			output:   "main.c:1:1: error: unknown type name\n",
+			want:     []Diagnostic{{Line: 11, Col: 2, Severity: SeverityError, Message: "unknown type name"}},
+		},
+		{
+			name:     "line outside of codeblock",
+			language: "c",
+			output:   "main.c:9:1: error: expected '}'\n",
+			want:     []Diagnostic{},
+		},
+		{
+			name:     "language without runner",
+			language: "ruby",
+			output:   "main.c:1:1: error: x\n",
+			want:     []Diagnostic{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := &Codeblock{
+				Language:  tt.language,
+				StartLine: 10,
+				EndLine:   14,
+				Text:      "1\n2\n3\n",
+				Fence:     Fence{Char: '`', Length: 3, Indent: tt.indent},
+				Opts:      map[string]string{},
+			}
+			got := ParseDiagnostics(cb, "/code", "/work", tt.output)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// maxDiffLines limits the lines of both texts that are left after their
+// common start and end. Diffing takes time with the square of the number of
+// lines, so beyond that only the line counts are reported
+const maxDiffLines = 10000
+
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// UnifiedDiff returns the differences between from and to in unified diff
+// format. Returns an empty string when both are equal
+func UnifiedDiff(fromName string, toName string, from string, to string) string {
+	a, b := splitDiffLines(from), splitDiffLines(to)
+	prefix, suffix := commonLines(a, b)
+	if len(a)+len(b)-2*(prefix+suffix) > maxDiffLines {
+		return fmt.Sprintf("--- %s\n+++ %s\n%d lines differ from %d lines, which are too many to diff\n",
+			fromName, toName, len(a)-prefix-suffix, len(b)-prefix-suffix)
+	}
+	ops := diffLines(a, b)
+
+	// aPos and bPos hold the number of lines of from and to before each op
+	aPos := make([]int, len(ops)+1)
+	bPos := make([]int, len(ops)+1)
+	changed := false
+	for i, op := range ops {
+		aPos[i+1] = aPos[i]
+		bPos[i+1] = bPos[i]
+		if op.kind != '+' {
+			aPos[i+1]++
+		}
+		if op.kind != '-' {
+			bPos[i+1]++
+		}
+		if op.kind != ' ' {
+			changed = true
+		}
+	}
+	if !changed {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("--- %s\n+++ %s\n", fromName, toName))
+
+	i := 0
+	for i < len(ops) {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+
+		start := max(i-diffContext, 0)
+		end := i
+		for {
+			for end < len(ops) && ops[end].kind != ' ' {
+				end++
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next < len(ops) && next-end <= 2*diffContext {
+				end = next
+				continue
+			}
+			end = min(end+diffContext, len(ops))
+			break
+		}
+
+		aCount := aPos[end] - aPos[start]
+		bCount := bPos[end] - bPos[start]
+		sb.WriteString(fmt.Sprintf("@@ -%s +%s @@\n", hunkRange(aPos[start], aCount), hunkRange(bPos[start], bCount)))
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			sb.WriteString("\n")
+		}
+		i = end
+	}
+
+	return sb.String()
+}
+
+func hunkRange(start int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+func splitDiffLines(text string) []string {
+	if text == "" {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffLines computes the shortest edit script from a to b with the linear
+// space variant of the myers diff algorithm
+func diffLines(a []string, b []string) []diffOp {
+	return appendDiff(make([]diffOp, 0, len(a)+len(b)), a, b)
+}
+
+// appendDiff appends the edit script from a to b to ops. Lines that a and b
+// start and end with are kept, the rest is split at a point on the middle
+// snake of the edit script and both halves are diffed on their own
+func appendDiff(ops []diffOp, a []string, b []string) []diffOp {
+	prefix, suffix := commonLines(a, b)
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{kind: ' ', line: line})
+	}
+	tail := a[len(a)-suffix:]
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	switch {
+	case len(a) == 0:
+		for _, line := range b {
+			ops = append(ops, diffOp{kind: '+', line: line})
+		}
+	case len(b) == 0:
+		for _, line := range a {
+			ops = append(ops, diffOp{kind: '-', line: line})
+		}
+	default:
+		x, y := middleSnake(a, b)
+		ops = appendDiff(ops, a[:x], b[:y])
+		ops = appendDiff(ops, a[x:], b[y:])
+	}
+
+	for _, line := range tail {
+		ops = append(ops, diffOp{kind: ' ', line: line})
+	}
+	return ops
+}
+
+// commonLines returns the number of lines that a and b start and end with
+func commonLines(a []string, b []string) (prefix int, suffix int) {
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	return prefix, suffix
+}
+
+// middleSnake searches the shortest edit script from a to b from both ends at
+// once, and returns the point where both searches meet. Only the furthest
+// point on each diagonal is kept, so memory grows with the number of lines
+// and not with the number of edits. a and b must not start or end with the
+// same line
+func middleSnake(a []string, b []string) (int, int) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	// forward[offset+k] is the furthest x on diagonal k = x-y searching from
+	// the start, backward the same searching from the end of a and b
+	forward := make([]int, 2*maxD+2)
+	backward := make([]int, 2*maxD+2)
+	for i := range forward {
+		forward[i] = -1
+		backward[i] = -1
+	}
+	forward[offset+1] = 0
+	backward[offset+1] = 0
+
+	delta := n - m
+	// with an odd delta, the searches meet while searching forward
+	front := delta%2 != 0
+	// diagonals that left a or b are skipped from then on
+	kStart, kEnd, rkStart, rkEnd := 0, 0, 0, 0
+	for d := 0; d < maxD; d++ {
+		for k := -d + kStart; k <= d-kEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || (k != d && forward[i-1] < forward[i+1]) {
+				x = forward[i+1]
+			} else {
+				x = forward[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[i] = x
+			switch {
+			case x > n:
+				kEnd += 2
+			case y > m:
+				kStart += 2
+			case front:
+				j := offset + delta - k
+				if j >= 0 && j < len(backward) && backward[j] != -1 && x >= n-backward[j] {
+					return x, y
+				}
+			}
+		}
+
+		for k := -d + rkStart; k <= d-rkEnd; k += 2 {
+			j := offset + k
+			var x int
+			if k == -d || (k != d && backward[j-1] < backward[j+1]) {
+				x = backward[j+1]
+			} else {
+				x = backward[j-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			backward[j] = x
+			switch {
+			case x > n:
+				rkEnd += 2
+			case y > m:
+				rkStart += 2
+			case !front:
+				i := offset + delta - k
+				if i >= 0 && i < len(forward) && forward[i] != -1 && forward[i] >= n-x {
+					return forward[i], forward[i] - (delta - k)
+				}
+			}
+		}
+	}
+
+	// only reached when a and b have nothing in common
+	return n, 0
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		to   string
+		want string
+	}{
+		{"equal", "a\nb\n", "a\nb\n", ""},
+		{"both empty", "", "", ""},
+		{
+			name: "changed line",
+			from: "a\nb\nc\n",
+			to:   "a\nx\nc\n",
+			want: "--- out\n+++ new\n@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n",
+		},
+		{
+			name: "from empty",
+			from: "",
+			to:   "a\n",
+			want: "--- out\n+++ new\n@@ -0,0 +1 @@\n+a\n",
+		},
+		{
+			name: "to empty",
+			from: "a\nb\n",
+			to:   "",
+			want: "--- out\n+++ new\n@@ -1,2 +0,0 @@\n-a\n-b\n",
+		},
+		{
+			name: "context is limited",
+			from: "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			to:   "1\n2\n3\n4\n5\n6\n7\n8\nx\n",
+			want: "--- out\n+++ new\n@@ -6,4 +6,4 @@\n 6\n 7\n 8\n-9\n+x\n",
+		},
+		{
+			name: "separate hunks",
+			from: "a\n1\n2\n3\n4\n5\n6\n7\nb\n",
+			to:   "A\n1\n2\n3\n4\n5\n6\n7\nB\n",
+			want: "--- out\n+++ new\n@@ -1,4 +1,4 @@\n-a\n+A\n 1\n 2\n 3\n@@ -6,4 +6,4 @@\n 5\n 6\n 7\n-b\n+B\n",
+		},
+		{
+			name: "close changes share a hunk",
+			from: "a\n1\n2\nb\n",
+			to:   "A\n1\n2\nB\n",
+			want: "--- out\n+++ new\n@@ -1,4 +1,4 @@\n-a\n+A\n 1\n 2\n-b\n+B\n",
+		},
+		{
+			name: "missing trailing newline is ignored",
+			from: "a\nb",
+			to:   "a\nb\n",
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := UnifiedDiff("out", "new", tt.from, tt.to); got != tt.want {
+				t.Errorf("UnifiedDiff(%q, %q) =\n%s\nwant\n%s", tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffLinesIsMinimal(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, r.Intn(15))
+		for i := range lines {
+			lines[i] = string(rune('a' + r.Intn(3)))
+		}
+		return lines
+	}
+	for i := 0; i < 5000; i++ {
+		a, b := randomLines(), randomLines()
+		ops := diffLines(a, b)
+
+		from, to := []string{}, []string{}
+		kept := 0
+		for _, op := range ops {
+			if op.kind != '+' {
+				from = append(from, op.line)
+			}
+			if op.kind != '-' {
+				to = append(to, op.line)
+			}
+			if op.kind == ' ' {
+				kept++
+			}
+		}
+		if !reflect.DeepEqual(from, a) || !reflect.DeepEqual(to, b) {
+			t.Fatalf("diff of %q and %q doesn't turn one into the other: %v", a, b, ops)
+		}
+		if want := longestCommonSubsequence(a, b); kept != want {
+			t.Fatalf("diff of %q and %q keeps %d lines, want %d", a, b, kept, want)
+		}
+	}
+}
+
+func TestUnifiedDiffTooManyLines(t *testing.T) {
+	from, to := strings.Builder{}, strings.Builder{}
+	from.WriteString("same\n")
+	to.WriteString("same\n")
+	for i := 0; i < maxDiffLines; i++ {
+		fmt.Fprintf(&from, "a%d\n", i)
+		fmt.Fprintf(&to, "b%d\n", i)
+	}
+	want := fmt.Sprintf("--- out\n+++ new\n%d lines differ from %d lines, which are too many to diff\n", maxDiffLines, maxDiffLines)
+	if got := UnifiedDiff("out", "new", from.String(), to.String()); got != want {
+		t.Errorf("UnifiedDiff() = %q, want %q", got, want)
+	}
+}
+
+// longestCommonSubsequence returns the number of lines that a and b have in
+// common, in the same order
+func longestCommonSubsequence(a []string, b []string) int {
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else {
+				lengths[i][j] = max(lengths[i+1][j], lengths[i][j+1])
+			}
+		}
+	}
+	return lengths[0][0]
+}
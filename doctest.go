@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// DocTestResult is the outcome of re-running a single codeblock and comparing
+// it with its out block
+type DocTestResult struct {
+	File      string
+	Codeblock *Codeblock
+	Duration  time.Duration
+	// Diff is set when the output differs from the out block
+	Diff string
+	// Err is set when the codeblock couldn't be run at all
+	Err error
+	// Skipped is set to the reason why the codeblock wasn't run or compared
+	Skipped string
+}
+
+// Name identifies the codeblock of the result
+func (r *DocTestResult) Name() string {
+	return strings.TrimSpace(fmt.Sprintf("%s:%d %s %s", r.File, r.Codeblock.StartLine+1, r.Codeblock.Language, r.Codeblock.GetID()))
+}
+
+// Failed returns whether the output or exit code didn't match
+func (r *DocTestResult) Failed() bool {
+	return r.Diff != ""
+}
+
+func testCommand(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	configPath := flags.String("config", "", "yaml or json config file (default: mdrun/config.yaml in the user config dir)")
+	junitPath := flags.String("junit", "", "write a junit xml report to this file")
+	verbose := flags.Bool("v", false, "also list codeblocks that passed or were skipped")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: mdrun test [flags] FILE.md...\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	config, err := LoadConfigFile(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		return 1
+	}
+	codeRunnerConfigs = config
+
+	exitCode := 0
+	results := map[string][]*DocTestResult{}
+	for _, file := range flags.Args() {
+		fileResults, err := testFile(file)
+		if err != nil {
+			printFileError(file, err)
+			exitCode = 1
+			continue
+		}
+		results[file] = fileResults
+
+		for _, r := range fileResults {
+			switch {
+			case r.Err != nil:
+				exitCode = 1
+				fmt.Printf("--- ERROR: %s (%s)\n    %v\n", r.Name(), r.Duration.Round(time.Millisecond), r.Err)
+			case r.Failed():
+				exitCode = 1
+				fmt.Printf("--- FAIL: %s (%s)\n%s", r.Name(), r.Duration.Round(time.Millisecond), r.Diff)
+			case r.Skipped != "" && *verbose:
+				fmt.Printf("--- SKIP: %s\n    %s\n", r.Name(), r.Skipped)
+			case r.Skipped == "" && *verbose:
+				fmt.Printf("--- PASS: %s (%s)\n", r.Name(), r.Duration.Round(time.Millisecond))
+			}
+		}
+	}
+
+	if *junitPath != "" {
+		if err := writeJunitReport(*junitPath, flags.Args(), results); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing junit report: %v\n", err)
+			exitCode = 1
+		}
+	}
+
+	if exitCode == 0 {
+		fmt.Println("PASS")
+	} else {
+		fmt.Println("FAIL")
+	}
+	return exitCode
+}
+
+// testFile re-runs all runnable codeblocks of a file in order and compares
+// the fresh output of those with an out block or expectations with them. The
+// file isn't modified
+func testFile(file string) ([]*DocTestResult, error) {
+	doc, err := readDocument(file)
+	if err != nil {
+		return nil, err
+	}
+	defer RemoveWorkspaces(doc.ID())
+	printDuplicateIDs(file, doc)
+
+	codeblocks, err := GetCodeblocks(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*DocTestResult{}
+	for _, cb := range codeblocks {
+		if !IsRunnable(cb) {
+			continue
+		}
+		result := &DocTestResult{
+			File:      file,
+			Codeblock: cb,
+		}
+		results = append(results, result)
+
+		if _, ok := cb.Opts[CbOptSession]; ok {
+			result.Skipped = "sessions need neovim"
+			continue
+		}
+
+		// codeblocks without anything to compare are run as well, as
+		// later codeblocks may depend on what they set up
+		start := time.Now()
+		execution, err := ExecuteCodeblock(cb)
+		result.Duration = time.Since(start)
+		if err != nil {
+			result.Err = err
+			continue
+		}
+
+		target := cb.FindTarget(codeblocks, "")
+		_, expectExit := cb.Opts[CbOptExpectExit]
+		if target == nil && !expectExit && len(cb.ExpectBlocks(codeblocks)) == 0 {
+			result.Skipped = "no out or expect block to compare with"
+			continue
+		}
+
+		if failures := CheckExpectations(cb, codeblocks, execution.ExitCode, execution.Outputs()); len(failures) > 0 {
+			result.Diff = strings.Join(failures, "\n") + "\n"
+		}
+		if target == nil {
+			continue
+		}
+
+		result.Diff += UnifiedDiff("expected", "actual", target.Text, normalizeOutputText(execution.Output))
+		if expected, ok := target.Opts[CbOptExitCode]; ok && expected != fmt.Sprintf("%d", execution.ExitCode) {
+			result.Diff = fmt.Sprintf("exit code: expected %s, got %d\n%s", expected, execution.ExitCode, result.Diff)
+		}
+		if expected := target.Opts[CbOptTimedOut] == "true"; expected != execution.TimedOut {
+			result.Diff = fmt.Sprintf("timed out: expected %t, got %t\n%s", expected, execution.TimedOut, result.Diff)
+		}
+		if errTarget := cb.FindTarget(codeblocks, StreamStderr); errTarget != nil && cb.SeparateStderr() {
+			result.Diff += UnifiedDiff("expected stderr", "actual stderr", errTarget.Text, normalizeOutputText(execution.Stderr))
+		}
+	}
+
+	return results, nil
+}
+
+// normalizeOutputText makes output comparable to the text of a codeblock read
+// from a document, which always ends with a newline unless it's empty
+func normalizeOutputText(text string) string {
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		return text + "\n"
+	}
+	return text
+}
+
+type junitTestsuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestsuite `xml:"testsuite"`
+}
+
+type junitTestsuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Testcases []junitTestcase `xml:"testcase"`
+}
+
+type junitTestcase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJunitReport writes one testsuite per file and one testcase per
+// codeblock to path
+func writeJunitReport(path string, files []string, results map[string][]*DocTestResult) error {
+	report := junitTestsuites{}
+	for _, file := range files {
+		fileResults, ok := results[file]
+		if !ok {
+			continue
+		}
+		suite := junitTestsuite{Name: file}
+		var total time.Duration
+		for _, r := range fileResults {
+			total += r.Duration
+			testcase := junitTestcase{
+				Name:      r.Name(),
+				Classname: file,
+				Time:      fmt.Sprintf("%.3f", r.Duration.Seconds()),
+			}
+			switch {
+			case r.Err != nil:
+				suite.Errors++
+				testcase.Error = &junitMessage{Message: r.Err.Error()}
+			case r.Failed():
+				suite.Failures++
+				testcase.Failure = &junitMessage{Message: "output differs from out block", Text: r.Diff}
+			case r.Skipped != "":
+				suite.Skipped++
+				testcase.Skipped = &junitMessage{Message: r.Skipped}
+			}
+			suite.Testcases = append(suite.Testcases, testcase)
+		}
+		suite.Tests = len(fileResults)
+		suite.Time = fmt.Sprintf("%.3f", total.Seconds())
+		report.Suites = append(report.Suites, suite)
+	}
+
+	data, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append([]byte(xml.Header), append(data, '\n')...), 0644)
+}
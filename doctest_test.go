@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTestFileRunsSetupCodeblocks(t *testing.T) {
+	useTestConfig(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "doc.md")
+	doc := strings.Join([]string{
+		"```sh",
+		"echo hi > greeting.txt",
+		"```",
+		"",
+		"```sh ID=2",
+		"cat greeting.txt",
+		"```",
+		"",
+		"```out SOURCE=2",
+		"hi",
+		"```",
+		"",
+	}, "\n")
+	if err := os.WriteFile(file, []byte(doc), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := testFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if results[0].Skipped == "" || results[0].Duration == 0 {
+		t.Errorf("setup codeblock wasn't run without comparing: %+v", results[0])
+	}
+	if r := results[1]; r.Err != nil || r.Failed() || r.Skipped != "" {
+		t.Errorf("codeblock using the setup failed: %v %q %q", r.Err, r.Diff, r.Skipped)
+	}
+}
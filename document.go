@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mrWinston/mdrun.nvim/pkg/runner"
+	log "github.com/sirupsen/logrus"
+)
+
+// Document is a markdown document that codeblocks are read from and written
+// to. Lines are zero based. Negative line numbers count from the end, so -1
+// is the position after the last line, like in nvim_buf_set_lines
+type Document interface {
+	// ID identifies the document, e.g. by its buffer number
+	ID() int
+	// Path returns the absolute path of the file of the document, empty if
+	// it has none
+	Path() string
+	// Lines returns a copy of all lines of the document
+	Lines() ([]string, error)
+	// Markdown returns the parsed lines of the document
+	Markdown() (*Markdown, error)
+	// SetLines replaces the lines from start up to, but excluding, end
+	SetLines(start int, end int, lines [][]byte) error
+	// SetStatus shows status next to line. A status set with the same id
+	// before is replaced
+	SetStatus(line int, id int, status string, highlight string) error
+	// SetHighlights replaces the highlights of the lines from start up to,
+	// but excluding, end
+	SetHighlights(start int, end int, highlights []Highlight) error
+	// SetVirtualLines shows lines below line. Lines set with the same id
+	// before are replaced, no lines remove them
+	SetVirtualLines(line int, id int, lines []string, highlight string) error
+	// SetDiagnostics replaces the diagnostics of the codeblock with the
+	// given id
+	SetDiagnostics(id string, diagnostics []Diagnostic) error
+	// SetAnchor anchors the lines from start to end, inclusive. The anchor
+	// moves along when lines are added or removed around them. An anchor set
+	// with the same id before is replaced
+	SetAnchor(id int, start int, end int) error
+	// Anchor returns the lines the anchor with the given id is at now. ok is
+	// false when there is no such anchor
+	Anchor(id int) (start int, end int, ok bool, err error)
+	// RemoveAnchor removes the anchor with the given id
+	RemoveAnchor(id int) error
+}
+
+// Editor is the front end that codeblocks are run from
+type Editor interface {
+	runner.Editor
+	// CurrentDocument returns the document that is currently edited
+	CurrentDocument() (Document, error)
+	// CursorLine returns the zero based line of the cursor in the current
+	// document
+	CursorLine() (int, error)
+	// Notify shows a message to the user
+	Notify(level log.Level, msg string) error
+}
+
+// Status is a status mark set on a MemoryDocument
+type Status struct {
+	Line      int
+	Text      string
+	Highlight string
+}
+
+// VirtualLines are lines shown below a line of a MemoryDocument
+type VirtualLines struct {
+	Line      int
+	Lines     []string
+	Highlight string
+}
+
+// anchorRange are the first and last line of an anchor
+type anchorRange struct {
+	start int
+	end   int
+}
+
+// MemoryDocument is a Document that only lives in memory, used when running
+// without an editor
+type MemoryDocument struct {
+	id           int
+	path         string
+	mutex        sync.RWMutex
+	markdown     *Markdown
+	statuses     map[int]Status
+	highlights   []Highlight
+	virtualLines map[int]VirtualLines
+	diagnostics  map[string][]Diagnostic
+	anchors      map[int]anchorRange
+}
+
+// NewMemoryDocument creates a document with a copy of the given lines
+func NewMemoryDocument(id int, lines []string) *MemoryDocument {
+	return &MemoryDocument{
+		id:           id,
+		markdown:     ParseMarkdown(lines),
+		statuses:     map[int]Status{},
+		virtualLines: map[int]VirtualLines{},
+		diagnostics:  map[string][]Diagnostic{},
+		anchors:      map[int]anchorRange{},
+	}
+}
+
+func (d *MemoryDocument) ID() int {
+	return d.id
+}
+
+func (d *MemoryDocument) Path() string {
+	return d.path
+}
+
+// SetPath sets the path of the file the document was read from
+func (d *MemoryDocument) SetPath(path string) {
+	d.path = path
+}
+
+func (d *MemoryDocument) Lines() ([]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.markdown.Lines(), nil
+}
+
+func (d *MemoryDocument) Markdown() (*Markdown, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.markdown, nil
+}
+
+func (d *MemoryDocument) SetLines(start int, end int, lines [][]byte) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	lineCount := d.markdown.LineCount()
+	if start < 0 {
+		start = lineCount + 1 + start
+	}
+	if end < 0 {
+		end = lineCount + 1 + end
+	}
+	if start < 0 || end > lineCount || start > end {
+		return fmt.Errorf("Index out of bounds: %d-%d in document with %d lines", start, end, lineCount)
+	}
+
+	newLines := make([]string, 0, len(lines))
+	for _, line := range lines {
+		newLines = append(newLines, string(line))
+	}
+	d.markdown = d.markdown.Edit(start, end, newLines)
+
+	// anchors move like extmarks, the ones in the replaced lines end up at
+	// their start
+	moveLine := func(line int) int {
+		switch {
+		case line >= end:
+			return line + len(lines) - (end - start)
+		case line >= start:
+			return start
+		}
+		return line
+	}
+	for id, anchor := range d.anchors {
+		d.anchors[id] = anchorRange{start: moveLine(anchor.start), end: moveLine(anchor.end)}
+	}
+
+	return nil
+}
+
+func (d *MemoryDocument) SetStatus(line int, id int, status string, highlight string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.statuses[id] = Status{
+		Line:      line,
+		Text:      status,
+		Highlight: highlight,
+	}
+	return nil
+}
+
+func (d *MemoryDocument) SetHighlights(start int, end int, highlights []Highlight) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	kept := []Highlight{}
+	for _, h := range d.highlights {
+		if h.Line < start || h.Line >= end {
+			kept = append(kept, h)
+		}
+	}
+	d.highlights = append(kept, highlights...)
+	return nil
+}
+
+func (d *MemoryDocument) SetVirtualLines(line int, id int, lines []string, highlight string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(lines) == 0 {
+		delete(d.virtualLines, id)
+		return nil
+	}
+	d.virtualLines[id] = VirtualLines{
+		Line:      line,
+		Lines:     append([]string{}, lines...),
+		Highlight: highlight,
+	}
+	return nil
+}
+
+// VirtualLines returns all virtual lines, keyed by their id
+func (d *MemoryDocument) VirtualLines() map[int]VirtualLines {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	virtualLines := map[int]VirtualLines{}
+	for id, lines := range d.virtualLines {
+		virtualLines[id] = lines
+	}
+	return virtualLines
+}
+
+func (d *MemoryDocument) SetDiagnostics(id string, diagnostics []Diagnostic) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(diagnostics) == 0 {
+		delete(d.diagnostics, id)
+		return nil
+	}
+	d.diagnostics[id] = append([]Diagnostic{}, diagnostics...)
+	return nil
+}
+
+func (d *MemoryDocument) SetAnchor(id int, start int, end int) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if start < 0 || end >= d.markdown.LineCount() || start > end {
+		return fmt.Errorf("Index out of bounds: %d-%d in document with %d lines", start, end, d.markdown.LineCount())
+	}
+	d.anchors[id] = anchorRange{start: start, end: end}
+	return nil
+}
+
+func (d *MemoryDocument) Anchor(id int) (int, int, bool, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	anchor, ok := d.anchors[id]
+	return anchor.start, anchor.end, ok, nil
+}
+
+func (d *MemoryDocument) RemoveAnchor(id int) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.anchors, id)
+	return nil
+}
+
+// Diagnostics returns all diagnostics, keyed by the id of their codeblock
+func (d *MemoryDocument) Diagnostics() map[string][]Diagnostic {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	diagnostics := map[string][]Diagnostic{}
+	for id, list := range d.diagnostics {
+		diagnostics[id] = list
+	}
+	return diagnostics
+}
+
+// Highlights returns all highlights of the document
+func (d *MemoryDocument) Highlights() []Highlight {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return append([]Highlight{}, d.highlights...)
+}
+
+// Statuses returns all status marks, keyed by their id
+func (d *MemoryDocument) Statuses() map[int]Status {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	statuses := map[int]Status{}
+	for id, status := range d.statuses {
+		statuses[id] = status
+	}
+	return statuses
+}
+
+// MemoryEditor is an Editor with a single MemoryDocument
+type MemoryEditor struct {
+	Document *MemoryDocument
+	Cursor   int
+}
+
+func (e *MemoryEditor) ExecLua(_ string, _ any, _ ...any) error {
+	return fmt.Errorf("Can't execute lua without neovim")
+}
+
+func (e *MemoryEditor) CurrentDocument() (Document, error) {
+	return e.Document, nil
+}
+
+func (e *MemoryEditor) CursorLine() (int, error) {
+	return e.Cursor, nil
+}
+
+func (e *MemoryEditor) Notify(level log.Level, msg string) error {
+	log.StandardLogger().Log(level, msg)
+	return nil
+}
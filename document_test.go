@@ -0,0 +1,248 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/mrWinston/mdrun.nvim/pkg/runner"
+)
+
+// useTestConfig runs sh codeblocks with the sh interpreter, shell codeblocks
+// in sh sessions and python codeblocks with python3 until the test has
+// finished
+func useTestConfig(t *testing.T) {
+	t.Helper()
+	previous := codeRunnerConfigs
+	t.Cleanup(func() { codeRunnerConfigs = previous })
+	codeRunnerConfigs = &Config{
+		LogDir:    t.TempDir(),
+		SocketDir: t.TempDir(),
+		RunnerConfigs: map[string]*RunnerConfig{
+			"sh":    {Languages: []string{"sh"}, Config: &runner.InterpretedRunner{Interpreter: "sh", FileName: "main.sh"}},
+			"shell": {Languages: []string{"shell"}, Config: &runner.ShellRunner{DefaultShell: "sh"}},
+			"python": {Languages: []string{"python"}, Config: &runner.InterpretedRunner{
+				Interpreter: "python3",
+				FileName:    "main.py",
+				Repl:        `python3 -q -u -i -c 'import sys; sys.ps1 = sys.ps2 = ""'`,
+				ReplExec:    `exec(compile(%q, "<block>", "exec"))`,
+			}},
+		},
+	}
+}
+
+// runCodeblockAt runs the codeblock at line of the document and waits until
+// it has finished
+func runCodeblockAt(t *testing.T, doc *MemoryDocument, line int) error {
+	t.Helper()
+	e := &MemoryEditor{Document: doc, Cursor: line}
+	cb, err := FindCodeblockUnderCursor(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := StartCodeblock(e, cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatalf("codeblock at line %d didn't finish", line)
+		return nil
+	}
+}
+
+// codeblockLine returns the first line of the code of the codeblock with
+// the given text
+func codeblockLine(t *testing.T, doc *MemoryDocument, text string) int {
+	t.Helper()
+	cbs, err := GetCodeblocks(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cb := range cbs {
+		if cb.Text == text {
+			return cb.StartLine + 1
+		}
+	}
+	t.Fatalf("no codeblock with text %q", text)
+	return 0
+}
+
+// outBlocks returns the out blocks of the document
+func outBlocks(t *testing.T, doc *MemoryDocument) []*Codeblock {
+	t.Helper()
+	cbs, err := GetCodeblocks(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outs := []*Codeblock{}
+	for _, cb := range cbs {
+		if cb.Language == "out" {
+			outs = append(outs, cb)
+		}
+	}
+	return outs
+}
+
+func TestRunCodeblockInMemoryDocument(t *testing.T) {
+	useTestConfig(t)
+	doc := NewMemoryDocument(1, []string{
+		"# Run",
+		"",
+		"```env",
+		"GREETING=hello",
+		"```",
+		"",
+		"```sh",
+		"echo $GREETING",
+		"printf 'no newline'",
+		"```",
+		"",
+		"text",
+	})
+
+	for run := 0; run < 2; run++ {
+		// the out block is replaced by the second run
+		if err := runCodeblockAt(t, doc, 7); err != nil {
+			t.Fatal(err)
+		}
+		outs := outBlocks(t, doc)
+		if len(outs) != 1 {
+			t.Fatalf("run %d: got %d out blocks, want 1", run, len(outs))
+		}
+		out := outs[0]
+		if want := "hello\nno newline\n"; out.Text != want {
+			t.Errorf("run %d: output %q, want %q", run, out.Text, want)
+		}
+		if out.Opts[CbOptExitCode] != "0" || out.Opts[CbOptSource] == "" {
+			t.Errorf("run %d: out block options %v", run, out.Opts)
+		}
+		if out.StartLine != 10 {
+			t.Errorf("run %d: out block starts at %d, want 10", run, out.StartLine)
+		}
+	}
+
+	lines, _ := doc.Lines()
+	if last := lines[len(lines)-1]; last != "text" {
+		t.Errorf("last line is %q, want text", last)
+	}
+}
+
+func TestRunFailingCodeblockInMemoryDocument(t *testing.T) {
+	useTestConfig(t)
+	doc := NewMemoryDocument(2, []string{"```sh", "echo oops >&2", "exit 3", "```"})
+	if err := runCodeblockAt(t, doc, 1); err == nil {
+		t.Error("expected an error for exit code 3")
+	}
+	outs := outBlocks(t, doc)
+	if len(outs) != 1 {
+		t.Fatalf("got %d out blocks, want 1", len(outs))
+	}
+	if outs[0].Text != "oops\n" || outs[0].Opts[CbOptExitCode] != "3" {
+		t.Errorf("output %q with options %v", outs[0].Text, outs[0].Opts)
+	}
+}
+
+func TestSessionSurvivesInterrupt(t *testing.T) {
+	useTestConfig(t)
+	doc := NewMemoryDocument(3, []string{
+		"```shell SESSION=s",
+		"X=1",
+		"```",
+		"",
+		"```shell SESSION=s",
+		"sleep 30",
+		"```",
+		"",
+		"```shell SESSION=s",
+		"echo $X",
+		"```",
+	})
+	t.Cleanup(func() {
+		for _, se := range GetSessionsForDocument(doc.ID()) {
+			se.Close()
+		}
+	})
+
+	if err := runCodeblockAt(t, doc, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &MemoryEditor{Document: doc, Cursor: codeblockLine(t, doc, "sleep 30\n")}
+	cb, err := FindCodeblockUnderCursor(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := StartCodeblock(e, cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := GetSessionsForDocument(doc.ID())
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+	time.Sleep(300 * time.Millisecond)
+	if err := sessions[0].Interrupt(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("interrupted codeblock didn't finish")
+	}
+
+	if err := runCodeblockAt(t, doc, codeblockLine(t, doc, "echo $X\n")); err != nil {
+		t.Fatal(err)
+	}
+	outs := outBlocks(t, doc)
+	if last := outs[len(outs)-1]; last.Text != "1\n" {
+		t.Errorf("output after interrupt %q, want the state from before", last.Text)
+	}
+}
+
+func TestPythonSessionRunsBlockAsAWhole(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 isn't installed")
+	}
+	useTestConfig(t)
+	doc := NewMemoryDocument(4, []string{
+		"```python SESSION=py",
+		"for i in range(2):",
+		"    print(i)",
+		"print(\"done\")",
+		"",
+		"def f():",
+		"    x = 'a\\tb'",
+		"",
+		"    return x",
+		"```",
+		"",
+		"```python SESSION=py",
+		"print(f())",
+		"```",
+	})
+	t.Cleanup(func() {
+		for _, se := range GetSessionsForDocument(doc.ID()) {
+			se.Close()
+		}
+	})
+
+	if err := runCodeblockAt(t, doc, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCodeblockAt(t, doc, codeblockLine(t, doc, "print(f())\n")); err != nil {
+		t.Fatal(err)
+	}
+	outs := outBlocks(t, doc)
+	if len(outs) != 2 {
+		t.Fatalf("got %d out blocks, want 2", len(outs))
+	}
+	if want := "0\n1\ndone\n"; outs[0].Text != want {
+		t.Errorf("output of the loop %q, want %q", outs[0].Text, want)
+	}
+	if want := "a\tb\n"; outs[1].Text != want {
+		t.Errorf("output of the function %q, want %q", outs[1].Text, want)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ExpectLanguage is the language of blocks holding the expected output of
+	// the codeblock given by their SOURCE option
+	ExpectLanguage = "expect"
+	// MatchExact expects the output to be equal to the expect block
+	MatchExact = "exact"
+	// MatchContains expects the output to contain the expect block
+	MatchContains = "contains"
+	// MatchRegex expects the output to match the regular expression in the
+	// expect block
+	MatchRegex = "regex"
+)
+
+// IsExpectBlock returns whether the codeblock holds expected output
+func (cb *Codeblock) IsExpectBlock() bool {
+	return cb.Language == ExpectLanguage
+}
+
+// ExpectedExitCode returns the exit code of the EXPECT_EXIT option. ok is
+// false when the option isn't set, in which case 0 is expected
+func (cb *Codeblock) ExpectedExitCode() (code int, ok bool, err error) {
+	val, ok := cb.Opts[CbOptExpectExit]
+	if !ok {
+		return 0, false, nil
+	}
+	code, err = strconv.Atoi(val)
+	if err != nil {
+		return 0, false, fmt.Errorf("Invalid %s '%s', expected a number", CbOptExpectExit, val)
+	}
+	return code, true, nil
+}
+
+// Succeeded returns whether target holds the output of a run that exited
+// with the expected exit code
+func (cb *Codeblock) Succeeded(target *Codeblock) bool {
+	expected, _, _ := cb.ExpectedExitCode()
+	return target.Opts[CbOptExitCode] == strconv.Itoa(expected)
+}
+
+// ExpectBlocks returns the expect blocks of the codeblock
+func (cb *Codeblock) ExpectBlocks(codeblocks []*Codeblock) []*Codeblock {
+	expectBlocks := []*Codeblock{}
+	for _, current := range codeblocks {
+		if current.IsExpectBlock() && cb.HasRef(current.Opts[CbOptSource]) {
+			expectBlocks = append(expectBlocks, current)
+		}
+	}
+	return expectBlocks
+}
+
+// CheckExpectations compares the result of a run of cb with its EXPECT_EXIT
+// option and its expect blocks. outputs holds the output of every stream,
+// keyed by the STREAM of its out block. Returns a description of every
+// mismatch
+func CheckExpectations(cb *Codeblock, codeblocks []*Codeblock, exitCode int, outputs map[string]string) []string {
+	failures := []string{}
+	if expected, ok, err := cb.ExpectedExitCode(); err != nil {
+		failures = append(failures, err.Error())
+	} else if ok && expected != exitCode {
+		failures = append(failures, fmt.Sprintf("exit code: expected %d, got %d", expected, exitCode))
+	}
+
+	for _, expectBlock := range cb.ExpectBlocks(codeblocks) {
+		stream := expectBlock.Opts[CbOptStream]
+		output, ok := outputs[stream]
+		if !ok {
+			failures = append(failures, fmt.Sprintf("expect block at line %d: no output for stream '%s'", expectBlock.StartLine+1, stream))
+			continue
+		}
+		mismatch, err := matchExpectation(expectBlock.Opts[CbOptMatch], expectBlock.Text, output)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("expect block at line %d: %v", expectBlock.StartLine+1, err))
+			continue
+		}
+		if mismatch != "" {
+			failures = append(failures, mismatch)
+		}
+	}
+	return failures
+}
+
+// matchExpectation compares output with the text of an expect block. Returns
+// an empty string when it matches, otherwise a description of the mismatch
+func matchExpectation(mode string, expected string, output string) (string, error) {
+	switch mode {
+	case "", MatchExact:
+		return UnifiedDiff("expected", "actual", expected, normalizeOutputText(output)), nil
+	case MatchContains:
+		needle := strings.TrimSuffix(expected, "\n")
+		if strings.Contains(output, needle) {
+			return "", nil
+		}
+		return fmt.Sprintf("output doesn't contain:\n%s", indentLines(needle)), nil
+	case MatchRegex:
+		pattern := strings.TrimSuffix(expected, "\n")
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return "", fmt.Errorf("Invalid regex: %w", err)
+		}
+		if re.MatchString(output) {
+			return "", nil
+		}
+		return fmt.Sprintf("output doesn't match:\n%s", indentLines(pattern)), nil
+	default:
+		return "", fmt.Errorf("Invalid %s '%s', expected one of %s, %s, %s", CbOptMatch, mode, MatchExact, MatchContains, MatchRegex)
+	}
+}
+
+// indentLines indents every line of text by four spaces
+func indentLines(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = "    " + line
+	}
+	return strings.Join(lines, "\n")
+}
+
+// expectationsExtmarkID returns the id of the mark showing the failed
+// expectations of the codeblock. Ids of codeblocks are used for their status,
+// the following ones for the status of their out blocks
+func expectationsExtmarkID(cb *Codeblock) (int, error) {
+	id, err := strconv.Atoi(cb.GetID())
+	if err != nil {
+		return 0, err
+	}
+	return id + 3, nil
+}
+
+// clearExpectations removes the failed expectations shown for the codeblock
+func clearExpectations(cb *Codeblock) {
+	id, err := expectationsExtmarkID(cb)
+	if err != nil {
+		return
+	}
+	if err := cb.Document.SetVirtualLines(0, id, nil, ""); err != nil {
+		log.Errorf("Couldn't clear expectations of %s: %v", cb.Ref(), err)
+	}
+}
+
+// checkRun checks the expectations of source once it has run and shows
+// failed ones below its out block. A run that failed with the expected exit
+// code succeeds. Returns an error for failed expectations, otherwise the
+// error of the run
+func checkRun(source *Codeblock, target *Codeblock, exitCode int, runErr error) error {
+	codeblocks, err := GetCodeblocks(source.Document)
+	if err != nil {
+		return err
+	}
+	outputs := map[string]string{"": target.Text}
+	if errTarget := source.FindTarget(codeblocks, StreamStderr); errTarget != nil {
+		outputs[StreamStderr] = errTarget.Text
+	}
+
+	failures := CheckExpectations(source, codeblocks, exitCode, outputs)
+	if _, ok, _ := source.ExpectedExitCode(); ok && len(failures) == 0 {
+		runErr = nil
+	}
+
+	id, err := expectationsExtmarkID(source)
+	if err != nil {
+		return err
+	}
+	lines := []string{}
+	for _, failure := range failures {
+		lines = append(lines, strings.Split(strings.TrimSuffix(failure, "\n"), "\n")...)
+	}
+	if err := source.Document.SetVirtualLines(target.EndLine, id, lines, highlightGroupError); err != nil {
+		log.Errorf("Couldn't show expectations of %s: %v", source.Ref(), err)
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("Expectations of %s failed:\n%s", source.Ref(), strings.Join(failures, "\n"))
+	}
+	return runErr
+}
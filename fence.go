@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// DefaultFenceChar is the character of fences written for new codeblocks
+	DefaultFenceChar = '`'
+	// MinFenceLength is the least number of fence characters of a fence
+	MinFenceLength = 3
+)
+
+// Fence is the opening or closing line of a fenced codeblock, see
+// https://spec.commonmark.org/0.31.2/#fenced-code-blocks
+type Fence struct {
+	// Char is either ` or ~
+	Char byte
+	// Length is the number of fence characters
+	Length int
+	// Indent is the whitespace in front of the fence. It's up to 3 columns
+	// more than the content of the list item the codeblock is in, which is
+	// indented by the width of the list marker
+	Indent string
+	// Info is the text following the opening fence, as it is written
+	Info string
+}
+
+// UnclosedFenceError is returned when the fence opening a codeblock is never
+// closed
+type UnclosedFenceError struct {
+	// Line is the zero based line of the opening fence
+	Line  int
+	Fence Fence
+}
+
+func (e *UnclosedFenceError) Error() string {
+	return fmt.Sprintf("Unclosed codeblock fence '%s' at line %d", e.Fence.Marker(), e.Line+1)
+}
+
+// ParseFence parses line as an opening fence at the top level of a document.
+// ok is false when it isn't one
+func ParseFence(line string) (f Fence, ok bool) {
+	return ParseFenceIn(line, 0)
+}
+
+// ParseFenceIn parses line as an opening fence in a list item whose content
+// starts at column container. Fences indented by 4 or more columns beyond it
+// are part of an indented codeblock or paragraph instead
+func ParseFenceIn(line string, container int) (f Fence, ok bool) {
+	rest := strings.TrimLeft(line, " \t")
+	if rest == "" || (rest[0] != '`' && rest[0] != '~') {
+		return f, false
+	}
+	f.Char = rest[0]
+	f.Indent = line[:len(line)-len(rest)]
+	if indentWidth(f.Indent) > container+3 {
+		return f, false
+	}
+	for f.Length < len(rest) && rest[f.Length] == f.Char {
+		f.Length++
+	}
+	if f.Length < MinFenceLength {
+		return f, false
+	}
+	f.Info = rest[f.Length:]
+	// otherwise it's inline code at the start of a paragraph
+	if f.Char == '`' && strings.ContainsRune(f.Info, '`') {
+		return f, false
+	}
+	return f, true
+}
+
+// Closes returns whether line is a closing fence for this fence. It needs
+// the same character, at least the same length, no info and no more than 3
+// spaces of indentation beyond the opening fence
+func (f Fence) Closes(line string) bool {
+	rest := strings.TrimLeft(line, " \t")
+	if indentWidth(line[:len(line)-len(rest)]) > indentWidth(f.Indent)+3 {
+		return false
+	}
+	n := 0
+	for n < len(rest) && rest[n] == f.Char {
+		n++
+	}
+	return n >= f.Length && strings.TrimSpace(rest[n:]) == ""
+}
+
+// Marker returns the fence characters, ``` for a zero fence
+func (f Fence) Marker() string {
+	char, length := f.Char, f.Length
+	if char == 0 {
+		char = DefaultFenceChar
+	}
+	if length < MinFenceLength {
+		length = MinFenceLength
+	}
+	return strings.Repeat(string(char), length)
+}
+
+// ForText returns the fence lengthened so that no line of text closes it
+func (f Fence) ForText(text string) Fence {
+	if f.Char == 0 {
+		f.Char = DefaultFenceChar
+	}
+	if f.Length < MinFenceLength {
+		f.Length = MinFenceLength
+	}
+	for _, line := range strings.Split(text, "\n") {
+		rest := strings.TrimLeft(line, " \t")
+		n := 0
+		for n < len(rest) && rest[n] == f.Char {
+			n++
+		}
+		if n >= f.Length && strings.TrimSpace(rest[n:]) == "" {
+			f.Length = n + 1
+		}
+	}
+	return f
+}
+
+// Unindent removes up to the width of the indentation of the fence from the
+// start of a line between the fences
+func (f Fence) Unindent(line string) string {
+	return unindent(line, indentWidth(f.Indent))
+}
+
+// unindent removes up to width columns of whitespace from the start of line
+func unindent(line string, width int) string {
+	col := 0
+	i := 0
+	for i < len(line) && col < width {
+		switch line[i] {
+		case ' ':
+			col++
+		case '\t':
+			col += 4 - col%4
+		default:
+			return line[i:]
+		}
+		i++
+	}
+	return line[i:]
+}
+
+// Indented puts the indentation of the fence in front of a line between the
+// fences. Empty lines stay empty
+func (f Fence) Indented(line string) string {
+	if line == "" {
+		return line
+	}
+	return f.Indent + line
+}
+
+// indentWidth returns the number of columns of whitespace, with tab stops
+// every 4 columns
+func indentWidth(indent string) int {
+	col := 0
+	for _, c := range indent {
+		if c == '\t' {
+			col += 4 - col%4
+		} else {
+			col++
+		}
+	}
+	return col
+}
@@ -0,0 +1,104 @@
+package main
+
+import "testing"
+
+func TestParseFenceIn(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      string
+		container int
+		want      Fence
+		ok        bool
+	}{
+		{"backticks", "```", 0, Fence{Char: '`', Length: 3}, true},
+		{"tildes with info", "~~~ python ID=1", 0, Fence{Char: '~', Length: 3, Info: " python ID=1"}, true},
+		{"long fence", "`````go", 0, Fence{Char: '`', Length: 5, Info: "go"}, true},
+		{"indented by 3", "   ```sh", 0, Fence{Char: '`', Length: 3, Indent: "   ", Info: "sh"}, true},
+		{"indented by 4", "    ```sh", 0, Fence{}, false},
+		{"tab is 4 columns", "\t```sh", 0, Fence{}, false},
+		{"in list item", "    ```sh", 2, Fence{Char: '`', Length: 3, Indent: "    ", Info: "sh"}, true},
+		{"too deep in list item", "      ```sh", 2, Fence{}, false},
+		{"two backticks", "``sh", 0, Fence{}, false},
+		{"inline code", "```code``` text", 0, Fence{}, false},
+		{"backtick in tilde info", "~~~ a`b", 0, Fence{Char: '~', Length: 3, Info: " a`b"}, true},
+		{"text", "some text", 0, Fence{}, false},
+		{"empty", "", 0, Fence{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseFenceIn(tt.line, tt.container)
+			if ok != tt.ok {
+				t.Fatalf("ParseFenceIn(%q, %d) ok = %v, want %v", tt.line, tt.container, ok, tt.ok)
+			}
+			if ok && got != tt.want {
+				t.Errorf("ParseFenceIn(%q, %d) = %+v, want %+v", tt.line, tt.container, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFenceCloses(t *testing.T) {
+	tests := []struct {
+		name  string
+		fence Fence
+		line  string
+		want  bool
+	}{
+		{"same fence", Fence{Char: '`', Length: 3}, "```", true},
+		{"longer fence", Fence{Char: '`', Length: 3}, "`````", true},
+		{"shorter fence", Fence{Char: '`', Length: 4}, "```", false},
+		{"other char", Fence{Char: '`', Length: 3}, "~~~", false},
+		{"with info", Fence{Char: '`', Length: 3}, "```sh", false},
+		{"trailing space", Fence{Char: '`', Length: 3}, "```  ", true},
+		{"indented by 3", Fence{Char: '`', Length: 3}, "   ```", true},
+		{"indented by 4", Fence{Char: '`', Length: 3}, "    ```", false},
+		{"indented like the fence", Fence{Char: '~', Length: 3, Indent: "  "}, "     ~~~", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.fence.Closes(tt.line); got != tt.want {
+				t.Errorf("%+v.Closes(%q) = %v, want %v", tt.fence, tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFenceForText(t *testing.T) {
+	tests := []struct {
+		name  string
+		fence Fence
+		text  string
+		want  string
+	}{
+		{"zero fence", Fence{}, "echo hi\n", "```"},
+		{"text with fence", Fence{Char: '`', Length: 3}, "```\nnested\n```\n", "````"},
+		{"text with longer fence", Fence{Char: '`', Length: 3}, "`````\n", "``````"},
+		{"text with other fence", Fence{Char: '~', Length: 3}, "```\n", "~~~"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.fence.ForText(tt.text).Marker(); got != tt.want {
+				t.Errorf("ForText(%q).Marker() = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFenceUnindent(t *testing.T) {
+	fence := Fence{Char: '`', Length: 3, Indent: "  "}
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"  echo", "echo"},
+		{"    echo", "  echo"},
+		{" echo", "echo"},
+		{"\techo", "echo"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := fence.Unindent(tt.line); got != tt.want {
+			t.Errorf("Unindent(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
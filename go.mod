@@ -3,14 +3,16 @@ module github.com/mrWinston/mdrun.nvim
 go 1.21.4
 
 require (
+	github.com/creack/pty v1.1.24
 	github.com/neovim/go-client v1.2.1
 	github.com/sirupsen/logrus v1.9.3
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require golang.org/x/exp v0.0.0-20220303212507-bbda1eaf7a17 // indirect
 
 require (
 	github.com/samber/lo v1.39.0
-	github.com/smacker/go-tree-sitter v0.0.0-20231215063300-06670b6cd560
-	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
+	github.com/smacker/go-tree-sitter v0.0.0-20240827094217-dd81d9e9be82
+	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8
 )
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// HasRef returns whether ref is the ID or the NAME of the codeblock
+func (cb *Codeblock) HasRef(ref string) bool {
+	if ref == "" {
+		return false
+	}
+	return ref == cb.Opts[CbOptID] || ref == cb.Opts[CbOptName]
+}
+
+// FindTarget returns the out block of the codeblock for the given stream
+// among codeblocks. Out blocks whose SOURCE is the ID of the codeblock are
+// preferred over ones that use its NAME. Returns nil when there is none
+func (cb *Codeblock) FindTarget(codeblocks []*Codeblock, stream string) *Codeblock {
+	var byName *Codeblock
+	for _, current := range codeblocks {
+		if !current.IsTargetOf(cb, stream) {
+			continue
+		}
+		if id := cb.Opts[CbOptID]; id != "" && current.Opts[CbOptSource] == id {
+			return current
+		}
+		if byName == nil {
+			byName = current
+		}
+	}
+	return byName
+}
+
+// sourceExtmarkID returns the id of the status mark of the codeblock that
+// the out block belongs to. SOURCE can be a NAME, which is looked up
+func (cb *Codeblock) sourceExtmarkID() (int, error) {
+	source := cb.Opts[CbOptSource]
+	if id, err := strconv.Atoi(source); err == nil {
+		return id, nil
+	}
+	sourceBlock, err := FindCodeblockByRef(source, cb.Document)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(sourceBlock.Opts[CbOptID])
+}
+
+// FixDuplicateIDs gives codeblocks that have the same ID as an earlier one,
+// usually because they were copied, a new ID. Out blocks right below such a
+// codeblock are moved to the new ID with it. Returns a warning for every
+// changed codeblock and for duplicate names, which are left alone
+func FixDuplicateIDs(doc Document) ([]string, error) {
+	codeblocks, err := GetCodeblocks(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	warnings := []string{}
+	seenIDs := map[string]*Codeblock{}
+	seenNames := map[string]*Codeblock{}
+	for i, cb := range codeblocks {
+		if _, ok := cb.Opts[CbOptSource]; ok {
+			continue
+		}
+
+		if name := cb.Opts[CbOptName]; name != "" {
+			if first, ok := seenNames[name]; ok {
+				warnings = append(warnings, fmt.Sprintf("Codeblock at line %d has the same NAME '%s' as the one at line %d", cb.StartLine+1, name, first.StartLine+1))
+			} else {
+				seenNames[name] = cb
+			}
+		}
+
+		id := cb.Opts[CbOptID]
+		if id == "" {
+			continue
+		}
+		first, ok := seenIDs[id]
+		if !ok {
+			seenIDs[id] = cb
+			continue
+		}
+
+		cb.Opts[CbOptID] = NewCodeblockID()
+		// all lines are replaced one by one, so the line numbers stay valid
+		if err := doc.SetLines(cb.StartLine, cb.StartLine+1, cb.GetMarkdownLines()[:1]); err != nil {
+			return warnings, fmt.Errorf("Couldn't update id of codeblock at line %d: %w", cb.StartLine+1, err)
+		}
+		for _, next := range codeblocks[i+1:] {
+			if next.Opts[CbOptSource] != id {
+				break
+			}
+			next.Opts[CbOptSource] = cb.Opts[CbOptID]
+			if err := doc.SetLines(next.StartLine, next.StartLine+1, next.GetMarkdownLines()[:1]); err != nil {
+				return warnings, fmt.Errorf("Couldn't update out block at line %d: %w", next.StartLine+1, err)
+			}
+		}
+		warnings = append(warnings, fmt.Sprintf("Codeblock at line %d had the same ID %s as the one at line %d, changed it to %s", cb.StartLine+1, id, first.StartLine+1, cb.Opts[CbOptID]))
+	}
+	return warnings, nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+type infoTokenKind int
+
+const (
+	infoTokenLanguage infoTokenKind = iota
+	infoTokenAttr
+	infoTokenFlag
+	// infoTokenClass is a .class in braces, the first one is the language
+	infoTokenClass
+	// infoTokenID is an #id in braces, which sets the NAME of the codeblock
+	infoTokenID
+	infoTokenOpen
+	infoTokenClose
+)
+
+// infoToken is a part of an info string
+type infoToken struct {
+	kind infoTokenKind
+	// sep is the whitespace, or the commas in braces, in front of the token
+	sep string
+	// raw is the token as written
+	raw   string
+	key   string
+	value string
+}
+
+// InfoString is the parsed info string of a fence. Besides plain attributes
+// like `python CWD="/my dir" skip`, it understands the brace syntax of Pandoc
+// and Quarto, like `{.python #setup key=val}` and `{python}`. Attributes
+// without a value are set to "true"
+type InfoString struct {
+	Language string
+	Opts     map[string]string
+
+	tokens   []infoToken
+	trailing string
+}
+
+// ParseInfoString parses the text following an opening fence
+func ParseInfoString(info string) *InfoString {
+	is := &InfoString{Opts: map[string]string{}}
+	inBraces := false
+	first := true
+	for i := 0; i < len(info); {
+		start := i
+		for i < len(info) && isInfoSeparator(info, i, inBraces) {
+			i++
+		}
+		if i == len(info) {
+			is.trailing = info[start:]
+			break
+		}
+		tok := infoToken{sep: info[start:i]}
+
+		switch {
+		case info[i] == '{' && !inBraces:
+			tok.kind, tok.raw = infoTokenOpen, "{"
+			inBraces, first = true, true
+			i++
+			is.tokens = append(is.tokens, tok)
+			continue
+		case info[i] == '}' && inBraces:
+			tok.kind, tok.raw = infoTokenClose, "}"
+			inBraces = false
+			i++
+			is.tokens = append(is.tokens, tok)
+			continue
+		}
+
+		end := scanInfoToken(info, i, inBraces)
+		tok.raw = info[i:end]
+		i = end
+
+		if eq := infoKeyEnd(tok.raw); eq > 0 {
+			tok.kind = infoTokenAttr
+			tok.key = tok.raw[:eq]
+			tok.value = unquoteInfoValue(tok.raw[eq+1:])
+			is.Opts[tok.key] = tok.value
+		} else if inBraces && strings.HasPrefix(tok.raw, ".") && len(tok.raw) > 1 {
+			tok.kind = infoTokenClass
+			tok.value = tok.raw[1:]
+			if is.Language == "" {
+				tok.kind = infoTokenLanguage
+				is.Language = tok.value
+			}
+		} else if inBraces && strings.HasPrefix(tok.raw, "#") && len(tok.raw) > 1 {
+			tok.kind = infoTokenID
+			tok.value = unquoteInfoValue(tok.raw[1:])
+			is.Opts[CbOptName] = tok.value
+		} else if first && is.Language == "" {
+			tok.kind = infoTokenLanguage
+			tok.value = unquoteInfoValue(tok.raw)
+			is.Language = tok.value
+		} else {
+			tok.kind = infoTokenFlag
+			tok.key = unquoteInfoValue(tok.raw)
+			is.Opts[tok.key] = "true"
+		}
+		first = false
+		is.tokens = append(is.tokens, tok)
+	}
+	return is
+}
+
+// Render returns the info string for the given language and options. The
+// parts of the parsed info string are kept as they were written as far as
+// they didn't change. Options that weren't in it are added at its end
+func (is *InfoString) Render(language string, opts map[string]string) string {
+	var sb strings.Builder
+	written := map[string]bool{}
+	hasLanguage := false
+	inBraces := false
+	listSep := " "
+
+	writeNew := func() {
+		for _, key := range sortedOptKeys(opts) {
+			if written[key] {
+				continue
+			}
+			written[key] = true
+			sb.WriteString(listSep)
+			sb.WriteString(key)
+			sb.WriteString("=")
+			sb.WriteString(quoteInfoValue(opts[key], '"'))
+		}
+	}
+
+	if !slices.ContainsFunc(is.tokens, func(t infoToken) bool { return t.kind == infoTokenLanguage }) {
+		sb.WriteString(language)
+		hasLanguage = true
+	}
+
+	for _, tok := range is.tokens {
+		switch tok.kind {
+		case infoTokenOpen:
+			inBraces = true
+			sb.WriteString(tok.sep + tok.raw)
+		case infoTokenClose:
+			writeNew()
+			inBraces = false
+			sb.WriteString(tok.sep + tok.raw)
+		case infoTokenLanguage:
+			if hasLanguage {
+				continue
+			}
+			hasLanguage = true
+			sb.WriteString(tok.sep)
+			switch {
+			case language == tok.value:
+				sb.WriteString(tok.raw)
+			case strings.HasPrefix(tok.raw, "."):
+				sb.WriteString("." + language)
+			default:
+				sb.WriteString(language)
+			}
+		case infoTokenClass:
+			sb.WriteString(tok.sep + tok.raw)
+		case infoTokenID:
+			name, ok := opts[CbOptName]
+			if !ok || written[CbOptName] {
+				continue
+			}
+			written[CbOptName] = true
+			sb.WriteString(tok.sep)
+			if name == tok.value {
+				sb.WriteString(tok.raw)
+			} else {
+				sb.WriteString("#" + quoteInfoValue(name, '"'))
+			}
+		case infoTokenAttr, infoTokenFlag:
+			val, ok := opts[tok.key]
+			if !ok || written[tok.key] {
+				continue
+			}
+			written[tok.key] = true
+			sb.WriteString(tok.sep)
+			switch {
+			case tok.kind == infoTokenFlag && val == "true":
+				sb.WriteString(tok.raw)
+			case tok.kind == infoTokenAttr && val == tok.value:
+				sb.WriteString(tok.raw)
+			default:
+				quote := byte('"')
+				if eq := infoKeyEnd(tok.raw); eq > 0 && strings.HasPrefix(tok.raw[eq+1:], "'") {
+					quote = '\''
+				}
+				sb.WriteString(tok.key + "=" + quoteInfoValue(val, quote))
+			}
+		}
+		if inBraces && strings.Contains(tok.sep, ",") {
+			listSep = tok.sep
+		}
+	}
+	writeNew()
+	sb.WriteString(is.trailing)
+	return sb.String()
+}
+
+// sortedOptKeys returns the keys of opts with ID and SOURCE first
+func sortedOptKeys(opts map[string]string) []string {
+	keys := []string{}
+	for k := range opts {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a string, b string) int {
+		if rankA, rankB := optKeyRank(a), optKeyRank(b); rankA != rankB {
+			return rankA - rankB
+		}
+		return strings.Compare(a, b)
+	})
+	return keys
+}
+
+// optKeyRank returns where a key goes in sortedOptKeys: ID, then SOURCE,
+// then all other keys
+func optKeyRank(key string) int {
+	switch key {
+	case CbOptID:
+		return 0
+	case CbOptSource:
+		return 1
+	}
+	return 2
+}
+
+// isInfoSeparator returns whether the character at i separates tokens.
+// Commas separate tokens in braces when they end one, as in {r, echo=FALSE}
+func isInfoSeparator(info string, i int, inBraces bool) bool {
+	switch info[i] {
+	case ' ', '\t':
+		return true
+	case ',':
+		return inBraces
+	}
+	return false
+}
+
+// scanInfoToken returns the end of the token starting at i. Quotes and
+// backslashes keep whitespace in tokens
+func scanInfoToken(info string, i int, inBraces bool) int {
+	var quote byte
+	for ; i < len(info); i++ {
+		c := info[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			}
+		case quote == '"':
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				quote = 0
+			}
+		case c == '\\':
+			i++
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ' ' || c == '\t':
+			return i
+		case inBraces && c == '}':
+			return i
+		case inBraces && c == ',' && (i+1 == len(info) || strings.ContainsRune(" \t}", rune(info[i+1]))):
+			return i
+		}
+	}
+	return min(i, len(info))
+}
+
+// infoKeyEnd returns the index of the = after the key of an attribute, or -1
+// when the token isn't one
+func infoKeyEnd(raw string) int {
+	eq := strings.IndexByte(raw, '=')
+	if eq <= 0 || strings.ContainsAny(raw[:eq], "\"'\\") {
+		return -1
+	}
+	return eq
+}
+
+// unquoteInfoValue removes the quotes and escapes of a value. Backslashes
+// escape the next character outside of quotes and " and \ in double quotes,
+// single quotes keep everything as it is
+func unquoteInfoValue(raw string) string {
+	var sb strings.Builder
+	var quote byte
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				sb.WriteByte(c)
+			}
+		case quote == '"':
+			if c == '\\' && i+1 < len(raw) && (raw[i+1] == '"' || raw[i+1] == '\\') {
+				i++
+				sb.WriteByte(raw[i])
+			} else if c == '"' {
+				quote = 0
+			} else {
+				sb.WriteByte(c)
+			}
+		case c == '\\' && i+1 < len(raw):
+			i++
+			sb.WriteByte(raw[i])
+		case c == '"' || c == '\'':
+			quote = c
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// quoteInfoValue quotes a value when it's empty or contains characters that
+// would end it, preferably with the given quote
+func quoteInfoValue(val string, quote byte) string {
+	if val != "" && !strings.ContainsAny(val, " \t\"'\\{}") && !strings.HasSuffix(val, ",") {
+		return val
+	}
+	if quote == '\'' && !strings.Contains(val, "'") {
+		return "'" + val + "'"
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(val)
+	return `"` + escaped + `"`
+}
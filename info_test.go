@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseInfoString(t *testing.T) {
+	tests := []struct {
+		name     string
+		info     string
+		language string
+		opts     map[string]string
+	}{
+		{"empty", "", "", map[string]string{}},
+		{"language", "python", "python", map[string]string{}},
+		{"attributes", " python ID=12 SESSION=a", "python", map[string]string{"ID": "12", "SESSION": "a"}},
+		{"flag", "sh skip", "sh", map[string]string{"skip": "true"}},
+		{"double quotes", `sh CWD="/my dir"`, "sh", map[string]string{"CWD": "/my dir"}},
+		{"single quotes", `sh CWD='/my dir'`, "sh", map[string]string{"CWD": "/my dir"}},
+		{"escaped quote", `sh MSG="say \"hi\""`, "sh", map[string]string{"MSG": `say "hi"`}},
+		{"adjacent quotes", `sh MSG='it''s'`, "sh", map[string]string{"MSG": "its"}},
+		{"braces", "{.python #setup key=val}", "python", map[string]string{"NAME": "setup", "key": "val"}},
+		{"braces language", "{r, echo=FALSE}", "r", map[string]string{"echo": "FALSE"}},
+		{"classes after language", "{.python .numberLines}", "python", map[string]string{}},
+		{"attribute only", "ID=1", "", map[string]string{"ID": "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := ParseInfoString(tt.info)
+			if is.Language != tt.language {
+				t.Errorf("ParseInfoString(%q).Language = %q, want %q", tt.info, is.Language, tt.language)
+			}
+			if !reflect.DeepEqual(is.Opts, tt.opts) {
+				t.Errorf("ParseInfoString(%q).Opts = %v, want %v", tt.info, is.Opts, tt.opts)
+			}
+		})
+	}
+}
+
+func TestInfoStringRender(t *testing.T) {
+	tests := []struct {
+		name     string
+		info     string
+		language string
+		opts     map[string]string
+		want     string
+	}{
+		{"unchanged", " python  CWD='/tmp' skip", "python", map[string]string{"CWD": "/tmp", "skip": "true"}, " python  CWD='/tmp' skip"},
+		{"new options are sorted", "sh", "sh", map[string]string{"b": "1", "SOURCE": "2", "a": "3", "ID": "4"}, "sh ID=4 SOURCE=2 a=3 b=1"},
+		{"changed value keeps quotes", "sh CWD='/tmp'", "sh", map[string]string{"CWD": "/my dir"}, "sh CWD='/my dir'"},
+		{"single quote in single quoted value", "sh MSG='a'", "sh", map[string]string{"MSG": "it's"}, `sh MSG="it's"`},
+		{"value with space is quoted", "sh", "sh", map[string]string{"CWD": "/my dir"}, `sh CWD="/my dir"`},
+		{"removed option", "sh ID=1 skip", "sh", map[string]string{"ID": "1"}, "sh ID=1"},
+		{"changed language", "sh ID=1", "bash", map[string]string{"ID": "1"}, "bash ID=1"},
+		{"no language", "", "out", map[string]string{"SOURCE": "1"}, "out SOURCE=1"},
+		{"braces", "{.python #setup}", "python", map[string]string{"NAME": "setup", "ID": "1"}, "{.python #setup ID=1}"},
+		{"braces with commas", "{r, echo=FALSE}", "r", map[string]string{"echo": "FALSE", "ID": "1"}, "{r, echo=FALSE, ID=1}"},
+		{"renamed id", "{.python #setup}", "python", map[string]string{"NAME": "init"}, "{.python #init}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseInfoString(tt.info).Render(tt.language, tt.opts); got != tt.want {
+				t.Errorf("Render(%q) = %q, want %q", tt.info, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInfoStringRoundTrip(t *testing.T) {
+	for _, info := range []string{
+		"python",
+		" python ID=12 SESSION=a",
+		`sh CWD="/my dir" MSG='it''s' skip`,
+		"{.python #setup key=val}",
+		"{r, echo=FALSE, fig.width=7}",
+		"sh  ",
+	} {
+		is := ParseInfoString(info)
+		if got := is.Render(is.Language, is.Opts); got != info {
+			t.Errorf("Render of %q = %q", info, got)
+		}
+	}
+}
+
+func TestSortedOptKeys(t *testing.T) {
+	opts := map[string]string{"SOURCE": "", "b": "", "ID": "", "HASH": "", "a": ""}
+	want := []string{"ID", "SOURCE", "HASH", "a", "b"}
+	for i := 0; i < 10; i++ {
+		if got := sortedOptKeys(opts); !reflect.DeepEqual(got, want) {
+			t.Fatalf("sortedOptKeys() = %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// KeepBoth keeps the first and the last lines of truncated output
+	KeepBoth = "both"
+	// KeepHead keeps the first lines of truncated output
+	KeepHead = "head"
+	// KeepTail keeps the last lines of truncated output
+	KeepTail = "tail"
+)
+
+// OutputLimits caps the output written to an out block. 0 means no limit
+type OutputLimits struct {
+	MaxLines int
+	MaxBytes int
+	// Keep is which part of the output is kept, one of KeepBoth, KeepHead
+	// and KeepTail
+	Keep string
+}
+
+// OutputLimits returns the limits for the output of the codeblock, taken
+// from its MAX_LINES, MAX_BYTES and KEEP options or the config
+func (c *Config) OutputLimits(cb *Codeblock) (OutputLimits, error) {
+	limits := OutputLimits{
+		MaxLines: c.MaxLines,
+		MaxBytes: c.MaxBytes,
+		Keep:     KeepBoth,
+	}
+
+	for opt, limit := range map[string]*int{
+		CbOptMaxLines: &limits.MaxLines,
+		CbOptMaxBytes: &limits.MaxBytes,
+	} {
+		val, ok := cb.Opts[opt]
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return limits, fmt.Errorf("Invalid %s '%s', expected a positive number", opt, val)
+		}
+		*limit = n
+	}
+
+	if keep, ok := cb.Opts[CbOptKeep]; ok {
+		if keep != KeepBoth && keep != KeepHead && keep != KeepTail {
+			return limits, fmt.Errorf("Invalid %s '%s', expected one of %s, %s, %s", CbOptKeep, keep, KeepBoth, KeepHead, KeepTail)
+		}
+		limits.Keep = keep
+	}
+	return limits, nil
+}
+
+// Truncate removes lines from text until it fits the limits and puts a
+// marker with the number of omitted lines in their place. mapping holds the
+// line of text every line of the result comes from, -1 for the marker.
+// truncated is false when text already fits
+func (l OutputLimits) Truncate(text string) (result string, mapping []int, truncated bool) {
+	lines := codeblockTextLines(text)
+	total := len(lines)
+
+	n := total
+	if l.MaxLines > 0 && total > l.MaxLines {
+		n = l.MaxLines
+	}
+	var head, tail int
+	switch l.Keep {
+	case KeepHead:
+		head = n
+	case KeepTail:
+		tail = n
+	default:
+		head, tail = (n+1)/2, n/2
+	}
+
+	if l.MaxBytes > 0 {
+		size := 0
+		for _, line := range lines[:head] {
+			size += len(line) + 1
+		}
+		for _, line := range lines[total-tail:] {
+			size += len(line) + 1
+		}
+		// lines next to the omitted ones are dropped first
+		for size > l.MaxBytes && head+tail > 0 {
+			if tail > 0 && (head == 0 || tail >= head) {
+				size -= len(lines[total-tail]) + 1
+				tail--
+			} else {
+				size -= len(lines[head-1]) + 1
+				head--
+			}
+		}
+	}
+
+	omitted := total - head - tail
+	if omitted == 0 {
+		mapping = make([]int, total)
+		for i := range mapping {
+			mapping[i] = i
+		}
+		return text, mapping, false
+	}
+
+	kept := make([]string, 0, head+tail+1)
+	for i := 0; i < head; i++ {
+		kept = append(kept, lines[i])
+		mapping = append(mapping, i)
+	}
+	kept = append(kept, omittedMarker(omitted))
+	mapping = append(mapping, -1)
+	for i := total - tail; i < total; i++ {
+		kept = append(kept, lines[i])
+		mapping = append(mapping, i)
+	}
+
+	result = strings.Join(kept, "\n")
+	if strings.HasSuffix(text, "\n") {
+		result += "\n"
+	}
+	return result, mapping, true
+}
+
+// omittedMarker is the line that replaces omitted lines
+func omittedMarker(omitted int) string {
+	if omitted == 1 {
+		return "… 1 line omitted …"
+	}
+	return fmt.Sprintf("… %d lines omitted …", omitted)
+}
+
+// remapHighlights moves highlights to the lines given by mapping, see
+// OutputLimits.Truncate. Highlights of omitted lines are dropped
+func remapHighlights(highlights []Highlight, mapping []int) []Highlight {
+	newLines := map[int]int{}
+	for newLine, oldLine := range mapping {
+		if oldLine != -1 {
+			newLines[oldLine] = newLine
+		}
+	}
+
+	remapped := []Highlight{}
+	for _, h := range highlights {
+		newLine, ok := newLines[h.Line]
+		if !ok {
+			continue
+		}
+		h.Line = newLine
+		remapped = append(remapped, h)
+	}
+	return remapped
+}
+
+// WriteOutputLog writes the full output of the codeblock to a file in the
+// configured log dir and returns its path relative to that dir. stream is
+// added to the file name unless it's empty
+func WriteOutputLog(cb *Codeblock, stream string, output string) (string, error) {
+	logDir := codeRunnerConfigs.LogDir
+	if logDir == "" {
+		logDir = path.Join(os.TempDir(), "mdrun-logs")
+	}
+	err := os.MkdirAll(logDir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't create log dir: %w", err)
+	}
+
+	name := outputLogName(cb, stream)
+	err = os.WriteFile(path.Join(logDir, name), []byte(output), 0600)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't write output log: %w", err)
+	}
+	return name, nil
+}
+
+// outputLogName names the log of a codeblock after its document and a hash
+// of the document's absolute path, so that codeblocks with the same id in
+// other documents don't overwrite it
+func outputLogName(cb *Codeblock, stream string) string {
+	docPath := cb.Document.Path()
+	docName := strings.TrimSuffix(path.Base(docPath), path.Ext(docPath))
+	if docPath == "" {
+		docName = fmt.Sprintf("buffer%d", cb.Document.ID())
+	} else if abs, err := filepath.Abs(docPath); err == nil {
+		docPath = abs
+	}
+	sum := sha256.Sum256([]byte(docPath))
+
+	name := fmt.Sprintf("%s-%s-%s", docName, hex.EncodeToString(sum[:])[:8], cb.GetID())
+	if stream != "" {
+		name += "." + stream
+	}
+	return name + ".log"
+}
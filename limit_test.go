@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name      string
+		limits    OutputLimits
+		text      string
+		want      string
+		mapping   []int
+		truncated bool
+	}{
+		{"fits", OutputLimits{MaxLines: 5}, "1\n2\n", "1\n2\n", []int{0, 1}, false},
+		{"no limits", OutputLimits{}, "1\n2\n3\n", "1\n2\n3\n", []int{0, 1, 2}, false},
+		{"keep both", OutputLimits{MaxLines: 3}, "1\n2\n3\n4\n5\n", "1\n2\n… 2 lines omitted …\n5\n", []int{0, 1, -1, 4}, true},
+		{"keep head", OutputLimits{MaxLines: 2, Keep: KeepHead}, "1\n2\n3\n4\n5\n", "1\n2\n… 3 lines omitted …\n", []int{0, 1, -1}, true},
+		{"keep tail", OutputLimits{MaxLines: 2, Keep: KeepTail}, "1\n2\n3\n4\n5\n", "… 3 lines omitted …\n4\n5\n", []int{-1, 3, 4}, true},
+		{"one line omitted", OutputLimits{MaxLines: 2, Keep: KeepHead}, "1\n2\n3\n", "1\n2\n… 1 line omitted …\n", []int{0, 1, -1}, true},
+		{"no trailing newline", OutputLimits{MaxLines: 1, Keep: KeepHead}, "1\n2\n3", "1\n… 2 lines omitted …", []int{0, -1}, true},
+		{"bytes", OutputLimits{MaxBytes: 6}, "a1\na2\na3\na4\n", "a1\n… 2 lines omitted …\na4\n", []int{0, -1, 3}, true},
+		{"bytes of head", OutputLimits{MaxBytes: 7, Keep: KeepHead}, "a1\na2\na3\na4\n", "a1\na2\n… 2 lines omitted …\n", []int{0, 1, -1}, true},
+		{"lines and bytes", OutputLimits{MaxLines: 3, MaxBytes: 100, Keep: KeepTail}, "a1\na2\na3\na4\n", "… 1 line omitted …\na2\na3\na4\n", []int{-1, 1, 2, 3}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, mapping, truncated := tt.limits.Truncate(tt.text)
+			if got != tt.want {
+				t.Errorf("Truncate(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+			if !reflect.DeepEqual(mapping, tt.mapping) {
+				t.Errorf("mapping = %v, want %v", mapping, tt.mapping)
+			}
+			if truncated != tt.truncated {
+				t.Errorf("truncated = %v, want %v", truncated, tt.truncated)
+			}
+		})
+	}
+}
+
+func TestRemapHighlights(t *testing.T) {
+	highlights := []Highlight{{Line: 0, EndCol: 1}, {Line: 2, EndCol: 1}, {Line: 4, EndCol: 1}}
+	want := []Highlight{{Line: 0, EndCol: 1}, {Line: 3, EndCol: 1}}
+	if got := remapHighlights(highlights, []int{0, 1, -1, 4}); !reflect.DeepEqual(got, want) {
+		t.Errorf("remapHighlights() = %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteOutputLog(t *testing.T) {
+	useTestConfig(t)
+	names := map[string]bool{}
+	for _, docPath := range []string{"/a/doc.md", "/b/doc.md"} {
+		doc := NewMemoryDocument(1, []string{})
+		doc.SetPath(docPath)
+		cb := &Codeblock{Document: doc, Opts: map[string]string{CbOptID: "1"}}
+
+		name, err := WriteOutputLog(cb, "", docPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.IsAbs(name) || !strings.HasPrefix(name, "doc-") || !strings.HasSuffix(name, "-1.log") {
+			t.Errorf("log of %s is named %s", docPath, name)
+		}
+		names[name] = true
+
+		content, err := os.ReadFile(filepath.Join(codeRunnerConfigs.LogDir, name))
+		if err != nil || string(content) != docPath {
+			t.Errorf("log of %s holds %q, %v", docPath, content, err)
+		}
+	}
+	if len(names) != 2 {
+		t.Errorf("codeblocks with the same id in different documents share a log: %v", names)
+	}
+}
@@ -2,8 +2,18 @@ local M = {}
 
 -- default config
 M.config = {
-	stop_signal = "SIGINT", -- or SIGKILL
+	stop_signal = "SIGINT", -- first signal sent to stop a codeblock, followed by SIGTERM and SIGKILL
+  stop_grace_period = "3s", -- time between the signals
+  default_timeout = "", -- stop codeblocks running longer than this, e.g. "5m". Empty means no timeout
+  pty_size = "80x24", -- COLUMNSxROWS of the terminal for codeblocks with PTY=true
+  flush_interval = "100ms", -- how often new output is written to the out block, "0" writes every chunk
+  max_lines = 0, -- cap the lines of out blocks, 0 means no limit
+  max_bytes = 0, -- cap the size of out blocks, 0 means no limit
+  log_dir = vim.fn.stdpath("cache") .. "/mdrun/logs", -- full output of truncated out blocks
   docker_runtime = "podman", -- or docker
+  socket_dir = vim.fn.stdpath("cache") .. "/mdrun", -- unix sockets of running sessions
+  workspace_dir = "", -- where WORKSPACE dirs are created, empty means the temp dir
+  keep_workspaces = false, -- don't delete workspaces when their buffer is unloaded
 	runner_configs = {
 		c = {
 			type = "CompiledRunner",
@@ -32,6 +42,7 @@ M.config = {
 			config = {
         interpreter = "gomacro",
         repl = "gomacro -s",
+        repl_echo = "println(%q)",
         file_name = "main.go",
 			},
 		},
@@ -69,6 +80,7 @@ M.config = {
 			config = {
 				interpreter = "deno run",
         repl = "deno",
+        repl_echo = "console.log(%q)",
 				file_name = "main.js",
 			},
 		},
@@ -86,7 +98,9 @@ M.config = {
       image = "python",
 			config = {
 				interpreter = "python",
-        repl = "python",
+        repl = [[python -q -u -i -c 'import sys; sys.ps1 = sys.ps2 = ""']],
+        repl_echo = "print(%q)",
+        repl_exec = [[exec(compile(%q, "<block>", "exec"))]],
 				file_name = "main.py",
 			},
 		},
@@ -114,6 +128,7 @@ M.config = {
 			config = {
 				interpreter = "deno run",
         repl = "deno",
+        repl_echo = "console.log(%q)",
 				file_name = "main.ts",
 			},
 		},
@@ -137,9 +152,19 @@ M.setup = function(opts)
 
     call remote#host#RegisterPlugin('mdrun', '0', [
     \ {'type': 'autocmd', 'name': 'BufReadPost', 'sync': 0, 'opts': {'group': 'mdrun', 'pattern': '*.md'}},
+    \ {'type': 'autocmd', 'name': 'BufUnload', 'sync': 0, 'opts': {'eval': 'expand(''<abuf>'')', 'group': 'mdrun', 'pattern': '*.md'}},
+    \ {'type': 'autocmd', 'name': 'VimLeavePre', 'sync': 1, 'opts': {'group': 'mdrun', 'pattern': '*'}},
+    \ {'type': 'function', 'name': 'MdrunCheckStale', 'sync': 0, 'opts': {}},
+    \ {'type': 'function', 'name': 'MdrunCloseSessions', 'sync': 0, 'opts': {}},
     \ {'type': 'function', 'name': 'MdrunConfigure', 'sync': 1, 'opts': {}},
+    \ {'type': 'function', 'name': 'MdrunInterruptSession', 'sync': 0, 'opts': {}},
     \ {'type': 'function', 'name': 'MdrunKillCodeblock', 'sync': 0, 'opts': {}},
+    \ {'type': 'function', 'name': 'MdrunListSessions', 'sync': 1, 'opts': {}},
+    \ {'type': 'function', 'name': 'MdrunRestartSession', 'sync': 0, 'opts': {}},
+    \ {'type': 'function', 'name': 'MdrunRunBelow', 'sync': 0, 'opts': {}},
+    \ {'type': 'function', 'name': 'MdrunRunBuffer', 'sync': 0, 'opts': {}},
     \ {'type': 'function', 'name': 'MdrunRunCodeblock', 'sync': 0, 'opts': {}},
+    \ {'type': 'function', 'name': 'MdrunRunSection', 'sync': 0, 'opts': {}},
     \ ])
   ]])
 	vim.g.loaded_mdrun_nvim = true
@@ -155,4 +180,60 @@ M.run_codeblock_under_cursor = function()
   vim.fn.MdrunRunCodeblock()
 end
 
+-- marks out blocks whose codeblock changed since they were written. Also
+-- done when a markdown file is opened
+M.check_stale = function()
+  vim.fn.MdrunCheckStale()
+end
+
+-- the run_* functions stop at the first failing codeblock unless called with
+-- { continue = true }
+local run_all_args = function(opts)
+  if opts and opts.continue then
+    return "continue"
+  end
+  return ""
+end
+
+M.run_buffer = function(opts)
+  vim.fn.MdrunRunBuffer(run_all_args(opts))
+end
+
+M.run_section = function(opts)
+  vim.fn.MdrunRunSection(run_all_args(opts))
+end
+
+M.run_below = function(opts)
+  vim.fn.MdrunRunBelow(run_all_args(opts))
+end
+
+M.list_sessions = function()
+  local sessions = vim.fn.MdrunListSessions()
+  if #sessions == 0 then
+    vim.print("No running sessions")
+    return sessions
+  end
+  for _, s in ipairs(sessions) do
+    vim.print(string.format(
+      "%s [%s] buf=%d pid=%d up=%s last=%s%s",
+      s.name, s.language, s.buffer, s.pid, s.uptime, s.last_run, s.busy and " (busy)" or ""
+    ))
+  end
+  return sessions
+end
+
+-- the session functions act on the session of the codeblock under the cursor
+-- when no session id is given
+M.interrupt_session = function(id)
+  vim.fn.MdrunInterruptSession(id or "")
+end
+
+M.restart_session = function(id)
+  vim.fn.MdrunRestartSession(id or "")
+end
+
+M.close_sessions = function(bufnr)
+  vim.fn.MdrunCloseSessions(tostring(bufnr or 0))
+end
+
 return M
@@ -2,10 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,12 +23,18 @@ import (
 var clockAnimationGlyphs = []string{"󱑖", "󱑋", "󱑌", "󱑍", "󱑎", "󱑏", "󱑐", "󱑑", "󱑒", "󱑓", "󱑔", "󱑕"}
 var checkmarkGlyph = ""
 var errorGlyph = "󱂑"
+var staleGlyph = "󰑓"
 var highlightGroupError = "DiagnosticError"
 var highlightGroupOk = "DiagnosticOk"
 var highlightGroupInfo = "DiagnosticInfo"
+var highlightGroupWarn = "DiagnosticWarn"
 
 var codeRunnerConfigs *Config
 
+// bufferAttachTimeout is how long to wait for the lines of a newly attached
+// buffer
+var bufferAttachTimeout = 5 * time.Second
+
 // ContainerRuntimeDocker is the name of the docker container runtime
 const ContainerRuntimeDocker = "docker"
 
@@ -49,9 +58,10 @@ func Configure(_ *nvim.Nvim, args []string) error {
 // KillCodeblock stops the process associated with  a running codeblock. If the
 // codeblock doesn't have an associated process, this is a no-op
 func KillCodeblock(v *nvim.Nvim, _ []string) {
-	cb, err := FindCodeblockUnderCursor(v)
+	cb, err := FindCodeblockUnderCursor(NewNvimEditor(v))
 	if err != nil {
 		log.Errorf("No Codeblock under cursor found: %v", err)
+		return
 	}
 
   
@@ -64,6 +74,7 @@ func KillCodeblock(v *nvim.Nvim, _ []string) {
 	streamer, ok := GetStreamerWithID(id)
 	if !ok {
 		log.Warnf("Didn't find a streamer associated with the codeblock")
+		return
 	}
 
 	err = streamer.Kill()
@@ -72,18 +83,141 @@ func KillCodeblock(v *nvim.Nvim, _ []string) {
 	}
 }
 
-func handleSession(_ *nvim.Nvim, cb *Codeblock) {
-	sessionID := fmt.Sprintf("session_%s_%s", cb.Language, cb.Opts["SESSION"])
-	_, ok := GetStreamerWithID(sessionID)
+// SessionInfo describes a running session for MdrunListSessions
+type SessionInfo struct {
+	ID       string `msgpack:"id"`
+	Name     string `msgpack:"name"`
+	Language string `msgpack:"language"`
+	Buffer   int    `msgpack:"buffer"`
+	Pid      int    `msgpack:"pid"`
+	Uptime   string `msgpack:"uptime"`
+	LastRun  string `msgpack:"last_run"`
+	Busy     bool   `msgpack:"busy"`
+}
+
+// ListSessions returns all running sessions, ordered by their id
+func ListSessions(_ *nvim.Nvim, _ []string) ([]SessionInfo, error) {
+	infos := []SessionInfo{}
+	for _, se := range GetSessions() {
+		se.mutex.Lock()
+		lastRun := se.LastRun
+		se.mutex.Unlock()
+		infos = append(infos, SessionInfo{
+			ID:       se.ID,
+			Name:     se.Name,
+			Language: se.Language,
+			Buffer:   se.Document.ID(),
+			Pid:      se.Pid(),
+			Uptime:   time.Since(se.StartedAt).Round(time.Second).String(),
+			LastRun:  lastRun,
+			Busy:     se.Busy(),
+		})
+	}
+	slices.SortFunc(infos, func(a SessionInfo, b SessionInfo) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return infos, nil
+}
+
+// findSession returns the session with the id given as the first argument. If
+// there are no arguments, the session of the codeblock under the cursor is used
+func findSession(e Editor, args []string) (*Session, error) {
+	var id string
+	if len(args) > 0 && args[0] != "" {
+		id = args[0]
+	} else {
+		cb, err := FindCodeblockUnderCursor(e)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := cb.Opts[CbOptSession]; !ok {
+			return nil, fmt.Errorf("Codeblock under cursor has no session")
+		}
+		id = SessionID(cb)
+	}
+
+	se, ok := GetSession(id)
 	if !ok {
-		// create new one
-		_, found := codeRunnerConfigs.RunnerConfigs[cb.Language]
-		if !found {
-			log.Errorf("No runner for language %s", cb.Language)
+		return nil, fmt.Errorf("No running session with id %s", id)
+	}
+	return se, nil
+}
+
+// InterruptSession stops the current evaluation of a session without killing
+// its interpreter. Takes the session id as optional argument
+func InterruptSession(v *nvim.Nvim, args []string) {
+	go func() {
+		se, err := findSession(NewNvimEditor(v), args)
+		if err != nil {
+			log.Errorf("Can't find session: %v", err)
+			return
+		}
+
+		err = se.Interrupt()
+		if err != nil {
+			log.Errorf("Error interrupting session %s: %v", se.ID, err)
+		}
+	}()
+}
+
+// RestartSession replaces the interpreter of a session with a new one. Takes
+// the session id as optional argument
+func RestartSession(v *nvim.Nvim, args []string) {
+	go func() {
+		se, err := findSession(NewNvimEditor(v), args)
+		if err != nil {
+			log.Errorf("Can't find session: %v", err)
+			return
+		}
+
+		_, err = se.Restart()
+		if err != nil {
+			log.Errorf("Error restarting session %s: %v", se.ID, err)
 		}
+	}()
+}
 
-		_ = fmt.Sprintf("socat -u unix-listen:%s/%s.sock,fork - | %s", codeRunnerConfigs.SocketDir, sessionID, codeRunnerConfigs.RunnerConfigs[""])
+// CloseSessions stops all sessions of a buffer. Takes the buffer number as
+// optional argument, defaults to the current buffer
+func CloseSessions(v *nvim.Nvim, args []string) {
+	var docID int
+	if len(args) > 0 && args[0] != "" && args[0] != "0" {
+		var err error
+		docID, err = strconv.Atoi(args[0])
+		if err != nil {
+			log.Errorf("Invalid buffer number '%s': %v", args[0], err)
+			return
+		}
+	} else {
+		doc, err := NewNvimEditor(v).CurrentDocument()
+		if err != nil {
+			log.Errorf("Can't communicate with nvim: %v", err)
+			return
+		}
+		docID = doc.ID()
 	}
+
+	CloseSessionsForDocument(docID)
+}
+
+// handleSession evaluates the codeblock in its session, starting the session
+// first when it isn't running yet
+func handleSession(e Editor, cb *Codeblock, target *Codeblock, codeRunner runner.CodeblockRunner, envVars map[string]string, workdir string) (<-chan error, error) {
+	se, ok := GetSession(SessionID(cb))
+	if !ok {
+		replRunner, ok := codeRunner.(runner.ReplRunner)
+		if !ok {
+			return nil, fmt.Errorf("Runner for language %s doesn't support sessions", cb.Language)
+		}
+
+		var err error
+		se, err = StartSession(e, cb, replRunner, envVars, workdir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return se.Eval(cb, target)
 }
 
 // revive:disable:function-length
@@ -91,55 +225,149 @@ func handleSession(_ *nvim.Nvim, cb *Codeblock) {
 // revive:disable:cyclomatic
 // RunCodeblock looks up the codeblock under the cursor and runs it according to the configuration. Doesn't receive any args.
 func RunCodeblock(v *nvim.Nvim, _ []string) {
-  t := NewTimer(log.StandardLogger())
-	currentBuffer, err := v.CurrentBuffer()
+	// buffer line events are notifications as well and are only handled once
+	// this returns, so reading and writing the buffer has to happen elsewhere
+	go func() {
+		e := NewNvimEditor(v)
+		if doc, err := e.CurrentDocument(); err == nil {
+			fixDuplicateIDs(e, doc)
+		}
+		codeblockUnderCursor, err := FindCodeblockUnderCursor(e)
+		if err != nil {
+			log.Errorf("No codeblock under cursor found: %v", err)
+			var fenceErr *UnclosedFenceError
+			if errors.As(err, &fenceErr) {
+				e.Notify(log.ErrorLevel, fmt.Sprintf("mdrun: %v", err))
+			}
+			return
+		}
+
+		_, err = RunWithDependencies(e, codeblockUnderCursor)
+		if err != nil {
+			log.Errorf("Error running codeblock: %v", err)
+		}
+	}()
+}
+
+// RunBuffer runs all codeblocks of the current buffer. Pass "continue" to keep
+// going after a codeblock failed
+func RunBuffer(v *nvim.Nvim, args []string) {
+	runAll(v, RunScopeBuffer, args)
+}
+
+// RunSection runs all codeblocks of the heading section under the cursor.
+// Pass "continue" to keep going after a codeblock failed
+func RunSection(v *nvim.Nvim, args []string) {
+	runAll(v, RunScopeSection, args)
+}
+
+// RunBelow runs the codeblock under the cursor and all codeblocks after it.
+// Pass "continue" to keep going after a codeblock failed
+func RunBelow(v *nvim.Nvim, args []string) {
+	runAll(v, RunScopeBelow, args)
+}
+
+func runAll(v *nvim.Nvim, scope string, args []string) {
+	continueOnError := lo.Contains(args, "continue")
+	go func() {
+		e := NewNvimEditor(v)
+		if _, err := RunAll(e, scope, continueOnError); err != nil {
+			log.Errorf("Error running codeblocks: %v", err)
+			e.Notify(log.ErrorLevel, fmt.Sprintf("mdrun: %v", err))
+		}
+	}()
+}
+
+// CheckStale marks the out blocks of the current buffer whose codeblock
+// changed since they were written. Doesn't receive any args
+func CheckStale(v *nvim.Nvim, _ []string) {
+	go func() {
+		doc, err := NewNvimEditor(v).CurrentDocument()
+		if err != nil {
+			log.Errorf("Couldn't get current buffer: %v", err)
+			return
+		}
+		markStale(doc)
+	}()
+}
+
+func markStale(doc Document) {
+	stale, err := MarkStaleOutputs(doc)
 	if err != nil {
-		log.Errorf("Can't communicate with nvim: %v", err)
+		log.Errorf("Couldn't check for stale out blocks: %v", err)
 		return
 	}
-  t.Restart("Got current Buffer")
-  // 2seconds
-	codeblockUnderCursor, err := FindCodeblockUnderCursor(v)
+	log.Infof("Found %d stale out blocks in buffer %d", len(stale), doc.ID())
+}
+
+// fixDuplicateIDs gives copied codeblocks of the document new ids and warns
+// about it in the editor
+func fixDuplicateIDs(e Editor, doc Document) {
+	warnings, err := FixDuplicateIDs(doc)
 	if err != nil {
-		log.Errorf("No codeblock under cursor found: %v", err)
-		return
+		log.Errorf("Couldn't check for duplicate ids: %v", err)
+	}
+	for _, warning := range warnings {
+		log.Warn(warning)
+	}
+	if len(warnings) > 0 {
+		e.Notify(log.WarnLevel, "mdrun: "+strings.Join(warnings, "\n"))
 	}
-  t.Restart("Got Codeblock")
+}
 
-	var codeRunner runner.CodeblockRunner
-	for _, rc := range codeRunnerConfigs.RunnerConfigs {
-		if lo.Contains(rc.Languages, codeblockUnderCursor.Language) {
-			codeRunner = rc.Config
-			break
-		}
+// EnsureID adds an ID to the start line of the codeblock, unless it already
+// has one
+func EnsureID(cb *Codeblock) error {
+	if _, ok := cb.Opts[CbOptID]; ok {
+		return nil
+	}
+	cb.Opts[CbOptID] = NewCodeblockID()
+	// only the start line is written, the rest of the codeblock is unchanged
+	err := cb.Document.SetLines(cb.StartLine, cb.StartLine+1, cb.GetMarkdownLines()[:1])
+	if err != nil {
+		return fmt.Errorf("Coulnd't update source codeblock id: %w", err)
 	}
+	return nil
+}
+
+// StartCodeblock runs the codeblock according to the configuration. Its
+// output is streamed to its out codeblock, which is created if needed. The
+// returned channel receives the result once the codeblock has finished
+func StartCodeblock(e Editor, codeblockUnderCursor *Codeblock) (<-chan error, error) {
+  t := NewTimer(log.StandardLogger())
+
+	codeRunner := codeRunnerConfigs.FindRunner(codeblockUnderCursor.Language)
 	if codeRunner == nil {
-		log.Errorf("Couldn't find runner for language: %s", codeblockUnderCursor.Language)
-		return
+		return nil, fmt.Errorf("Couldn't find runner for language: %s", codeblockUnderCursor.Language)
 	}
   t.Restart("Got coderunner")
 
+	timeout, err := codeRunnerConfigs.Timeout(codeblockUnderCursor)
+	if err != nil {
+		return nil, err
+	}
+	ptySize, err := codeRunnerConfigs.TerminalSize(codeblockUnderCursor)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := codeRunnerConfigs.OutputLimits(codeblockUnderCursor); err != nil {
+		return nil, err
+	}
+	if _, _, err := codeblockUnderCursor.ExpectedExitCode(); err != nil {
+		return nil, err
+	}
+	if _, err := codeRunnerConfigs.Normalizer(codeblockUnderCursor); err != nil {
+		return nil, err
+	}
+
   // 2s block
-	if _, ok := codeblockUnderCursor.Opts["ID"]; !ok {
-		codeblockUnderCursor.Opts["ID"] = fmt.Sprintf("%d", time.Now().UnixMilli())
-		lines, ok := GetBufferLines(currentBuffer)
-		if !ok {
-			log.Errorf("Couldn't get buffer lines")
-			return
-		}
-		err = v.SetBufferLines(currentBuffer, codeblockUnderCursor.StartLine, codeblockUnderCursor.StartLine+1, true, [][]byte{
-			[]byte(fmt.Sprintf("%s %s=%s", lines[codeblockUnderCursor.StartLine], "ID", codeblockUnderCursor.Opts["ID"])),
-		})
-		if err != nil {
-			log.Errorf("Coulnd't update source codeblock id: %v", err)
-			return
-		}
+	if err := EnsureID(codeblockUnderCursor); err != nil {
+		return nil, err
 	}
   t.Restart("Set ID for CB under Cursor")
-
-	if _, ok := codeblockUnderCursor.Opts["SESSION"]; ok {
-		handleSession(v, codeblockUnderCursor)
-		return
+	// its out blocks and anchors are in use by the running one
+	if _, running := GetStreamerWithID(codeblockUnderCursor.GetID()); running {
+		return nil, fmt.Errorf("codeblock with id %s already running", codeblockUnderCursor.GetID())
 	}
 
 	outlanguage, ok := codeblockUnderCursor.Opts["OUT"]
@@ -147,72 +375,151 @@ func RunCodeblock(v *nvim.Nvim, _ []string) {
 		outlanguage = "out"
 	}
 
+	// 2s
+	envVars := codeblockUnderCursor.GetEnvVars()
+	t.Restart("Got Env Vars CB")
+	hash := codeblockUnderCursor.Hash(envVars)
+	// the workspace dir differs between runs, so it isn't part of the hash
+	envVars, err = WorkspaceEnvVars(codeblockUnderCursor, envVars)
+	if err != nil {
+		return nil, err
+	}
+	runnerOpts, err := RunnerOpts(codeblockUnderCursor, envVars)
+	if err != nil {
+		return nil, err
+	}
+
 	targetCodeBlock, err := codeblockUnderCursor.GetTargetCodeblock()
 
 	if err != nil {
 		log.Errorf("Error finding Target CB: %v", err)
 	}
 
+	if codeblockUnderCursor.IsCached(targetCodeBlock, hash) {
+		log.Infof("Codeblock %s didn't change, skipping", codeblockUnderCursor.Ref())
+		if err := codeblockUnderCursor.SetStatus(checkmarkGlyph, highlightGroupOk); err != nil {
+			log.Errorf("Couldn't set status on codeblock %v", err)
+		}
+		done := make(chan error, 1)
+		done <- nil
+		return done, nil
+	}
+
 	if targetCodeBlock == nil {
-		targetCodeBlock, err = NewTargetCodeblock(codeblockUnderCursor, v)
+		targetCodeBlock, err = NewTargetCodeblock(codeblockUnderCursor)
 		if err != nil || targetCodeBlock == nil {
-			log.Errorf("Error creating target codeblock: %v", err)
-			return
+			return nil, fmt.Errorf("Error creating target codeblock: %w", err)
 		}
 	}
   t.Restart("Got target CB")
 
 	targetCodeBlock.Language = outlanguage
+	targetCodeBlock.Opts[CbOptHash] = hash
+	targetCodeBlock.Text = ""
+	log.Debug("Right before emptying target")
+	if err := targetCodeBlock.Write(); err != nil {
+		return nil, fmt.Errorf("Couldn't write codeblock our: %w", err)
+	}
+  t.Restart("Emptied target CB")
+	clearExpectations(codeblockUnderCursor)
+	clearDiagnostics(codeblockUnderCursor)
 
-  // 2s
-	envVars := codeblockUnderCursor.GetEnvVars()
-  t.Restart("Got Env Vars CB")
-	if targetCodeBlock.Text != "" {
-		targetCodeBlock.Text = ""
-		log.Debug("Right before emptying target")
-		if err := targetCodeBlock.Write(v); err != nil {
-			log.Errorf("Couldn't write codeblock our: %v", err)
-			return
+	var errTarget *Codeblock
+	if _, session := codeblockUnderCursor.Opts[CbOptSession]; codeblockUnderCursor.SeparateStderr() && !session && ptySize == nil {
+		// a pseudo terminal and sessions only have a single output stream
+		errTarget, err = codeblockUnderCursor.GetStderrTargetCodeblock()
+		if err != nil {
+			log.Errorf("Error finding stderr target CB: %v", err)
+		}
+		if errTarget == nil {
+			errTarget, err = NewStderrTargetCodeblock(codeblockUnderCursor, targetCodeBlock)
+			if err != nil {
+				return nil, fmt.Errorf("Error creating stderr target codeblock: %w", err)
+			}
+		}
+		errTarget.Text = ""
+		delete(errTarget.Opts, CbOptLog)
+		if err := errTarget.Write(); err != nil {
+			return nil, fmt.Errorf("Couldn't empty stderr target codeblock: %w", err)
 		}
 	}
-  t.Restart("Emptied target CB")
 
-	cmd, err := codeRunner.CreateCommand(v, codeblockUnderCursor.Text, codeblockUnderCursor.Opts, envVars)
+	// the anchors are released once the codeblock has finished
+	started := false
+	defer func() {
+		if !started {
+			releaseAnchors(codeblockUnderCursor, targetCodeBlock, errTarget)
+		}
+	}()
+	for _, cb := range []*Codeblock{codeblockUnderCursor, targetCodeBlock, errTarget} {
+		if cb == nil {
+			continue
+		}
+		if err := cb.Anchor(); err != nil {
+			return nil, fmt.Errorf("Couldn't anchor codeblock at line %d: %w", cb.StartLine+1, err)
+		}
+	}
+
+	if _, ok := codeblockUnderCursor.Opts[CbOptSession]; ok {
+		done, err := handleSession(e, codeblockUnderCursor, targetCodeBlock, codeRunner, envVars, runner.Workdir(runnerOpts))
+		if err != nil {
+			return nil, fmt.Errorf("Error running codeblock in session: %w", err)
+		}
+		started = true
+		return done, nil
+	}
+
+	codeDir, err := runner.NewCodeDir("mdrun")
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create code dir: %w", err)
+	}
+	defer func() {
+		// the streamer removes it once the command has exited
+		if !started {
+			os.RemoveAll(codeDir)
+		}
+	}()
+	runnerOpts[runner.RUNNER_OPT_CODE_DIR] = codeDir
+
+	cmd, err := codeRunner.CreateCommand(e, codeblockUnderCursor.Text, runnerOpts, envVars)
 	if err != nil {
-		log.Errorf("Couldn't create command: %v", err)
+		return nil, fmt.Errorf("Couldn't create command: %w", err)
 	}
 
 	if codeblockUnderCursor.Opts["DOCKER"] == "true" {
 		cmd, err = WrapInContainer(cmd, codeblockUnderCursor)
 		if err != nil {
-			log.Errorf("Error wrapping in docker : %v", err)
-			return
+			return nil, fmt.Errorf("Error wrapping in docker : %w", err)
 		}
 	}
 
 	log.Infof("Running Command: %s", strings.Join(cmd.Args, " "))
 
 	s := &Streamer{
-		V:       v,
-		Source:  codeblockUnderCursor,
-		Target:  targetCodeBlock,
-		Command: cmd,
+		Source:    codeblockUnderCursor,
+		Target:    targetCodeBlock,
+		Command:   cmd,
+		Timeout:   timeout,
+		Pty:       ptySize,
+		ErrTarget: errTarget,
+		CodeDir:   codeDir,
 	}
 
 	err = AddStreamer(s)
 	if err != nil {
-		log.Errorf("Error adding streamer to running list: %v", err)
-		return
+		return nil, fmt.Errorf("Error adding streamer to running list: %w", err)
 	}
 
 	err = s.Run()
 	if err != nil {
-		log.Errorf("Error starting codeblock: %v", err)
+		return nil, fmt.Errorf("Error starting codeblock: %w", err)
 	}
+	started = true
+	return s.Done(), nil
 }
 
 // NewTargetCodeblock create a new out codeblock for the given codeblock and returns it.
-func NewTargetCodeblock(codeblockUnderCursor *Codeblock, v *nvim.Nvim) (*Codeblock, error) {
+func NewTargetCodeblock(codeblockUnderCursor *Codeblock) (*Codeblock, error) {
 	log.Debugf("Need to create target cb.")
 	codeBlockID := codeblockUnderCursor.Opts["ID"]
 	outlanguage, ok := codeblockUnderCursor.Opts["OUT"]
@@ -229,14 +536,16 @@ func NewTargetCodeblock(codeblockUnderCursor *Codeblock, v *nvim.Nvim) (*Codeblo
 		Opts: map[string]string{
 			"SOURCE": codeBlockID,
 		},
-		Text:   "",
-		Buffer: codeblockUnderCursor.Buffer,
+		Text:     "",
+		Fence:    Fence{Char: codeblockUnderCursor.Fence.Char, Indent: codeblockUnderCursor.Fence.Indent},
+		Document: codeblockUnderCursor.Document,
 	}
 
-	totalLines, err := v.BufferLineCount(codeblockUnderCursor.Buffer)
+	lines, err := codeblockUnderCursor.Document.Lines()
 	if err != nil {
 		return nil, err
 	}
+	totalLines := len(lines)
 	writeLine := codeblockUnderCursor.EndLine + 1
 
 	if codeblockUnderCursor.EndLine == totalLines-1 {
@@ -247,16 +556,14 @@ func NewTargetCodeblock(codeblockUnderCursor *Codeblock, v *nvim.Nvim) (*Codeblo
 	targetCodeBlock.StartLine = writeLine
 	targetCodeBlock.EndLine = writeLine - 1
 
-	err = v.SetBufferLines(codeblockUnderCursor.Buffer, writeLine, writeLine, false, [][]byte{[]byte(""), []byte("")})
+	err = codeblockUnderCursor.Document.SetLines(writeLine, writeLine, [][]byte{[]byte(""), []byte("")})
 	if err != nil {
 		return nil, err
 	}
 
-	err = v.SetBufferLines(
-		codeblockUnderCursor.Buffer,
+	err = codeblockUnderCursor.Document.SetLines(
 		targetCodeBlock.StartLine,
 		targetCodeBlock.EndLine+1,
-		false,
 		targetCodeBlock.GetMarkdownLines(),
 	)
 
@@ -269,27 +576,17 @@ func NewTargetCodeblock(codeblockUnderCursor *Codeblock, v *nvim.Nvim) (*Codeblo
 
 // GetTargetCodeblock finds the out codeblock for this codeblock. Returns nil when nothing is found.
 func (cb *Codeblock) GetTargetCodeblock() (*Codeblock, error) {
-	if cb.Opts[CbOptID] == "" {
+	if cb.Opts[CbOptID] == "" && cb.Opts[CbOptName] == "" {
 		return nil, fmt.Errorf("Can't get target of nodeblock without id")
 	}
-	codeblocks, err := GetCodeblocks(cb.Buffer)
-	var target *Codeblock
+	codeblocks, err := GetCodeblocks(cb.Document)
 
 	if err != nil {
 		log.Errorf("Error while parsing codeblocks: %v", err)
 		return nil, err
 	}
 
-	for _, currentBlock := range codeblocks {
-		id, ok := currentBlock.Opts[CbOptSource]
-
-		if ok && id == cb.Opts[CbOptID] {
-			target = currentBlock
-			break
-		}
-	}
-
-	return target, nil
+	return cb.FindTarget(codeblocks, ""), nil
 }
 
 // WrapInContainer modifies a given command so that it is run in the container runtime specified in the config
@@ -315,11 +612,19 @@ func WrapInContainer(originalCommand *exec.Cmd, cb *Codeblock) (*exec.Cmd, error
 
 	arguments := []string{}
 	arguments = append(arguments, "run", "--rm")
+	if ptySize, _ := codeRunnerConfigs.TerminalSize(cb); ptySize != nil {
+		arguments = append(arguments, "--tty")
+	}
 
+	// the code is mounted at the same path, as commands refer to it by its
+	// absolute path
+	codeDir := runner.CodeDirRoot()
 	if codeRunnerConfigs.DockerRuntime == ContainerRuntimePodman {
 		arguments = append(arguments, "--volume", fmt.Sprintf("%s:%s:z", originalCommand.Dir, inDockerWorkdir))
+		arguments = append(arguments, "--volume", fmt.Sprintf("%s:%s:z", codeDir, codeDir))
 	} else {
 		arguments = append(arguments, "--volume", fmt.Sprintf("%s:%s", originalCommand.Dir, inDockerWorkdir))
+		arguments = append(arguments, "--volume", fmt.Sprintf("%s:%s", codeDir, codeDir))
 	}
 
 	arguments = append(arguments, "--workdir", inDockerWorkdir)
@@ -358,9 +663,22 @@ func main() {
 	log.Debug("hello there!")
 	log.SetReportCaller(true)
 
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		// started from the command line instead of by neovim
+		os.Exit(RunCli(os.Args[1:]))
+	}
+
 	plugin.Main(func(p *plugin.Plugin) error {
 		p.HandleFunction(&plugin.FunctionOptions{Name: "MdrunRunCodeblock"}, RunCodeblock)
+		p.HandleFunction(&plugin.FunctionOptions{Name: "MdrunRunBuffer"}, RunBuffer)
+		p.HandleFunction(&plugin.FunctionOptions{Name: "MdrunRunSection"}, RunSection)
+		p.HandleFunction(&plugin.FunctionOptions{Name: "MdrunRunBelow"}, RunBelow)
 		p.HandleFunction(&plugin.FunctionOptions{Name: "MdrunKillCodeblock"}, KillCodeblock)
+		p.HandleFunction(&plugin.FunctionOptions{Name: "MdrunCheckStale"}, CheckStale)
+		p.HandleFunction(&plugin.FunctionOptions{Name: "MdrunListSessions"}, ListSessions)
+		p.HandleFunction(&plugin.FunctionOptions{Name: "MdrunInterruptSession"}, InterruptSession)
+		p.HandleFunction(&plugin.FunctionOptions{Name: "MdrunRestartSession"}, RestartSession)
+		p.HandleFunction(&plugin.FunctionOptions{Name: "MdrunCloseSessions"}, CloseSessions)
 		p.HandleFunction(&plugin.FunctionOptions{Name: "MdrunConfigure"}, Configure)
 		p.Handle(nvim.EventBufLines, HandleBufferLinesEvent)
 
@@ -382,6 +700,42 @@ func main() {
 				return
 			}
 			log.Infof("Subscribed for updates from buffer %d", curBuf)
+
+			go func() {
+				if !WaitForBufferLines(curBuf, bufferAttachTimeout) {
+					log.Warnf("Didn't receive lines of buffer %d, not checking for stale out blocks", curBuf)
+					return
+				}
+				doc := NewNvimDocument(p.Nvim, curBuf)
+				fixDuplicateIDs(NewNvimEditor(p.Nvim), doc)
+				markStale(doc)
+			}()
+		})
+
+		p.HandleAutocmd(&plugin.AutocmdOptions{
+			Event:   "BufUnload",
+			Group:   "mdrun",
+			Pattern: "*.md",
+			Eval:    "expand('<abuf>')",
+		}, func(buf string) {
+			docID, err := strconv.Atoi(buf)
+			if err != nil {
+				log.Errorf("Invalid buffer number '%s': %v", buf, err)
+				return
+			}
+			CloseSessionsForDocument(docID)
+			RemoveWorkspaces(docID)
+		})
+
+		// buffers aren't unloaded when nvim exits, so this has to be sync
+		// to finish before the plugin is stopped
+		p.HandleAutocmd(&plugin.AutocmdOptions{
+			Event:   "VimLeavePre",
+			Group:   "mdrun",
+			Pattern: "*",
+		}, func() error {
+			RemoveAllWorkspaces()
+			return nil
 		})
 
 		return nil
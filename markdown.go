@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+	ts "github.com/smacker/go-tree-sitter"
+	tsmd "github.com/smacker/go-tree-sitter/markdown/tree-sitter-markdown"
+)
+
+// Markdown is the parsed structure of a document: its fenced codeblocks and
+// headings. It never changes once parsed. Edit returns a new one that reuses
+// the syntax tree of what the edit didn't change, so it can be read while the
+// document is edited
+type Markdown struct {
+	lines []string
+	// lineStarts are the byte offsets of the lines in the parsed source
+	lineStarts []int
+	tree       *ts.Tree
+	blocks     []markdownBlock
+	headings   []Heading
+	// unclosed is the first fence that is never closed. Its codeblock isn't
+	// part of blocks
+	unclosed *UnclosedFenceError
+}
+
+// markdownBlock is a fenced codeblock as it was parsed
+type markdownBlock struct {
+	start    int
+	end      int
+	fence    Fence
+	language string
+	opts     map[string]string
+	text     string
+}
+
+// Heading is an ATX heading like "## Setup"
+type Heading struct {
+	Line  int
+	Level int
+	Text  string
+}
+
+// Section is the part of a document from a heading up to the next heading of
+// any level
+type Section struct {
+	Heading
+	// End is the line after the last line of the section
+	End int
+	// Parent is the index of the section of the closest heading before it with
+	// a lower level, -1 when there is none
+	Parent int
+}
+
+// ParseMarkdown parses the lines of a document
+func ParseMarkdown(lines []string) *Markdown {
+	md := parseMarkdown(append([]string{}, lines...), nil)
+	md.collect(&markdownWalk{})
+	return md
+}
+
+// Edit returns the document with the lines from first up to, but excluding,
+// last replaced. The syntax tree of the document is edited and parsed again,
+// which only parses the nodes the edit touched. The codeblocks and headings
+// above the edit are kept, and so are the ones from the first heading at the
+// start of a line below it, as they are parsed like before
+func (md *Markdown) Edit(first int, last int, replacement []string) *Markdown {
+	lines := make([]string, 0, len(md.lines)+len(replacement)-(last-first))
+	lines = append(lines, md.lines[:first]...)
+	lines = append(lines, replacement...)
+	lines = append(lines, md.lines[last:]...)
+	if md.tree == nil {
+		return ParseMarkdown(lines)
+	}
+
+	// the tree is edited in a copy, so md stays as it is
+	tree := md.tree.Copy()
+	start := md.byteOffset(first)
+	oldEnd := md.byteOffset(last)
+	newEnd := start
+	for _, line := range replacement {
+		newEnd += len(line) + 1
+	}
+	tree.Edit(ts.EditInput{
+		StartIndex:  uint32(start),
+		OldEndIndex: uint32(oldEnd),
+		NewEndIndex: uint32(newEnd),
+		StartPoint:  ts.Point{Row: uint32(first)},
+		OldEndPoint: ts.Point{Row: uint32(last)},
+		NewEndPoint: ts.Point{Row: uint32(first + len(replacement))},
+	})
+	edited := parseMarkdown(lines, tree)
+
+	// an unclosed fence above the edit can be closed by it, which changes
+	// everything after it
+	walk := &markdownWalk{previous: md, resume: first + len(replacement), delta: len(replacement) - (last - first)}
+	if md.unclosed == nil || md.unclosed.Line >= first {
+		walk.from = first
+		for _, b := range md.blocks {
+			if b.end < first {
+				edited.blocks = append(edited.blocks, b)
+			}
+		}
+		for _, h := range md.headings {
+			if h.Line < first {
+				edited.headings = append(edited.headings, h)
+			}
+		}
+	}
+	edited.collect(walk)
+	return edited
+}
+
+// parseMarkdown parses lines, reusing the nodes of old that weren't edited
+func parseMarkdown(lines []string, old *ts.Tree) *Markdown {
+	md := &Markdown{lines: lines, lineStarts: make([]int, len(lines))}
+	source := make([]byte, 0, len(lines)*40)
+	for i, line := range lines {
+		md.lineStarts[i] = len(source)
+		source = append(source, line...)
+		source = append(source, '\n')
+	}
+
+	parser := ts.NewParser()
+	parser.SetLanguage(tsmd.GetLanguage())
+	tree, err := parser.ParseCtx(context.Background(), old, source)
+	if err != nil {
+		// only happens when parsing is cancelled, which it never is
+		log.Errorf("Couldn't parse markdown: %v", err)
+		return md
+	}
+	md.tree = tree
+	return md
+}
+
+// markdownWalk is where collecting the codeblocks and headings of a syntax
+// tree starts and stops
+type markdownWalk struct {
+	// from is the first line that is collected, the ones above are kept
+	from int
+	// previous is the document before the edit, nil for a new one
+	previous *Markdown
+	// resume is the first line after the edit, delta the number of lines the
+	// edit added
+	resume int
+	delta  int
+}
+
+// collect adds the codeblocks and headings of the syntax tree
+func (md *Markdown) collect(walk *markdownWalk) {
+	if md.tree == nil {
+		return
+	}
+	cursor := ts.NewTreeCursor(md.tree.RootNode())
+	defer cursor.Close()
+	md.collectChildren(cursor, walk)
+}
+
+// collectChildren adds the codeblocks and headings below the node of cursor.
+// Only lists and sections can contain them, codeblocks in block quotes can't
+// be written back and are left out. The children are walked with the cursor,
+// as getting a child by its index walks all children before it. Returns
+// whether the rest of the document was taken from the previous one
+func (md *Markdown) collectChildren(cursor *ts.TreeCursor, walk *markdownWalk) bool {
+	if !cursor.GoToFirstChild() {
+		return false
+	}
+	defer cursor.GoToParent()
+	from := uint32(md.byteOffset(walk.from))
+	for {
+		node := cursor.CurrentNode()
+		if node.EndByte() < from {
+			// kept from the previous document
+			if !cursor.GoToNextSibling() {
+				return false
+			}
+			continue
+		}
+		switch node.Type() {
+		case "section", "list", "list_item":
+			if md.collectChildren(cursor, walk) {
+				return true
+			}
+		case "atx_heading":
+			line, col := md.position(node.StartByte())
+			if strings.HasPrefix(md.lines[line], "#") && md.resumeAt(line, walk) {
+				return true
+			}
+			if heading, ok := parseHeading(md.lines[line][col:]); ok && line >= walk.from {
+				heading.Line = line
+				md.headings = append(md.headings, heading)
+			}
+		case "fenced_code_block":
+			md.collectCodeblock(node, walk.from)
+		}
+		if !cursor.GoToNextSibling() {
+			return false
+		}
+	}
+}
+
+// resumeAt takes the codeblocks and headings from line on from the previous
+// document if line is below the edit and a heading there too. Nothing is
+// open at a heading at the start of a line, so the lines after it are parsed
+// like before
+func (md *Markdown) resumeAt(line int, walk *markdownWalk) bool {
+	previous := walk.previous
+	if previous == nil || line < walk.resume {
+		return false
+	}
+	line -= walk.delta
+	// only the first unclosed fence is known, there can be more after it
+	if previous.unclosed != nil && previous.unclosed.Line < line {
+		return false
+	}
+	i := sort.Search(len(previous.headings), func(i int) bool {
+		return previous.headings[i].Line >= line
+	})
+	if i == len(previous.headings) || previous.headings[i].Line != line {
+		return false
+	}
+
+	for _, h := range previous.headings[i:] {
+		h.Line += walk.delta
+		md.headings = append(md.headings, h)
+	}
+	for _, b := range previous.blocks {
+		if b.start > line {
+			b.start += walk.delta
+			b.end += walk.delta
+			md.blocks = append(md.blocks, b)
+		}
+	}
+	if md.unclosed == nil && previous.unclosed != nil && previous.unclosed.Line > line {
+		md.unclosed = &UnclosedFenceError{Line: previous.unclosed.Line + walk.delta, Fence: previous.unclosed.Fence}
+	}
+	return true
+}
+
+// collectCodeblock adds the fenced codeblock node unless it ends above from
+// or its fence shares the line with a list marker
+func (md *Markdown) collectCodeblock(node *ts.Node, from int) {
+	delimiters := getChildNodesWithType(node, "fenced_code_block_delimiter")
+	start, col := md.position(delimiters[0].StartByte())
+	indent := md.lines[start][:col]
+	if strings.TrimLeft(indent, " \t") != "" {
+		return
+	}
+	fence, ok := ParseFenceIn(md.lines[start], indentWidth(indent))
+	if !ok {
+		return
+	}
+	if len(delimiters) < 2 {
+		if md.unclosed == nil {
+			md.unclosed = &UnclosedFenceError{Line: start, Fence: fence}
+		}
+		return
+	}
+	end, _ := md.position(delimiters[len(delimiters)-1].StartByte())
+	if end < from {
+		return
+	}
+	md.blocks = append(md.blocks, newMarkdownBlock(md.lines, start, end, fence))
+}
+
+// getChildNodesWithType returns the children of node with the type nodeType
+func getChildNodesWithType(node *ts.Node, nodeType string) []*ts.Node {
+	children := []*ts.Node{}
+	for i := 0; i < int(node.ChildCount()); i++ {
+		currentChild := node.Child(i)
+		if currentChild == nil || currentChild.Type() != nodeType {
+			continue
+		}
+		children = append(children, currentChild)
+	}
+	return children
+}
+
+// position returns the line and column of a byte offset of the source. The
+// rows of an edited tree aren't reliable, but its byte offsets are
+func (md *Markdown) position(offset uint32) (int, int) {
+	line := sort.Search(len(md.lineStarts), func(i int) bool {
+		return md.lineStarts[i] > int(offset)
+	}) - 1
+	return line, int(offset) - md.lineStarts[line]
+}
+
+// byteOffset returns where line starts in the source, the end of the source
+// for the line after the last one
+func (md *Markdown) byteOffset(line int) int {
+	if line < len(md.lines) {
+		return md.lineStarts[line]
+	}
+	if len(md.lines) == 0 {
+		return 0
+	}
+	last := len(md.lines) - 1
+	return md.lineStarts[last] + len(md.lines[last]) + 1
+}
+
+func newMarkdownBlock(lines []string, start int, end int, fence Fence) markdownBlock {
+	textLines := make([]string, 0, end-start-1)
+	for _, line := range lines[start+1 : end] {
+		textLines = append(textLines, fence.Unindent(line))
+	}
+	text := strings.Join(textLines, "\n")
+	if text != "" {
+		text += "\n"
+	}
+	info := ParseInfoString(fence.Info)
+	return markdownBlock{
+		start:    start,
+		end:      end,
+		fence:    fence,
+		language: info.Language,
+		opts:     info.Opts,
+		text:     text,
+	}
+}
+
+// parseHeading parses an ATX heading: up to 6 #s, indented by no more than 3
+// spaces and followed by whitespace or the end of the line
+func parseHeading(line string) (Heading, bool) {
+	rest := strings.TrimLeft(line, " ")
+	if len(line)-len(rest) > 3 {
+		return Heading{}, false
+	}
+	level := 0
+	for level < len(rest) && rest[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 {
+		return Heading{}, false
+	}
+	if level < len(rest) && rest[level] != ' ' && rest[level] != '\t' {
+		return Heading{}, false
+	}
+
+	text := strings.TrimSpace(rest[level:])
+	// a closing sequence of #s isn't part of the text
+	if trimmed := strings.TrimRight(text, "#"); trimmed == "" || strings.HasSuffix(trimmed, " ") || strings.HasSuffix(trimmed, "\t") {
+		text = strings.TrimSpace(trimmed)
+	}
+	return Heading{Level: level, Text: text}, true
+}
+
+// blockAt returns the codeblock that line is part of, including its fences
+func (md *Markdown) blockAt(line int) (markdownBlock, bool) {
+	i := sort.Search(len(md.blocks), func(i int) bool {
+		return md.blocks[i].start > line
+	}) - 1
+	if i < 0 || md.blocks[i].end < line {
+		return markdownBlock{}, false
+	}
+	return md.blocks[i], true
+}
+
+// Lines returns a copy of the lines of the document
+func (md *Markdown) Lines() []string {
+	return append([]string{}, md.lines...)
+}
+
+// LineCount returns the number of lines of the document
+func (md *Markdown) LineCount() int {
+	return len(md.lines)
+}
+
+// Line returns a line of the document, empty when it doesn't exist
+func (md *Markdown) Line(line int) string {
+	if line < 0 || line >= len(md.lines) {
+		return ""
+	}
+	return md.lines[line]
+}
+
+// Codeblocks returns the fenced codeblocks of the document, which belong to
+// doc. Fails when a fence isn't closed
+func (md *Markdown) Codeblocks(doc Document) ([]*Codeblock, error) {
+	if md.unclosed != nil {
+		unclosed := *md.unclosed
+		return nil, &unclosed
+	}
+	cbs := make([]*Codeblock, 0, len(md.blocks))
+	for _, b := range md.blocks {
+		cbs = append(cbs, &Codeblock{
+			Language:  b.language,
+			StartLine: b.start,
+			EndLine:   b.end,
+			Opts:      lo.Assign(b.opts),
+			Text:      b.text,
+			Fence:     b.fence,
+			Document:  doc,
+		})
+	}
+	return cbs, nil
+}
+
+// Headings returns the headings outside of codeblocks
+func (md *Markdown) Headings() []Heading {
+	return append([]Heading{}, md.headings...)
+}
+
+// Sections returns the sections of the document in the order they appear
+func (md *Markdown) Sections() []Section {
+	sections := make([]Section, 0, len(md.headings))
+	for i, h := range md.headings {
+		end := len(md.lines)
+		if i+1 < len(md.headings) {
+			end = md.headings[i+1].Line
+		}
+		parent := i - 1
+		for parent >= 0 && sections[parent].Level >= h.Level {
+			parent = sections[parent].Parent
+		}
+		sections = append(sections, Section{Heading: h, End: end, Parent: parent})
+	}
+	return sections
+}
+
+// sectionIndexAt returns the index of the section that line is in, -1 when
+// it's above the first heading
+func sectionIndexAt(sections []Section, line int) int {
+	return sort.Search(len(sections), func(i int) bool {
+		return sections[i].Line > line
+	}) - 1
+}
+
+// SectionRangeAt returns the first line and the line after the end of the
+// innermost heading section containing line, including its subsections
+func (md *Markdown) SectionRangeAt(line int) (int, int, error) {
+	sections := md.Sections()
+	idx := sectionIndexAt(sections, line)
+	if idx == -1 {
+		return 0, 0, fmt.Errorf("Line %d is not in a section", line+1)
+	}
+
+	end := len(md.lines)
+	for _, sec := range sections[idx+1:] {
+		if sec.Level <= sections[idx].Level {
+			end = sec.Line
+			break
+		}
+	}
+	return sections[idx].Line, end, nil
+}
+
+// EnvVars returns the variables set in env codeblocks of the section of cb
+// and the sections above it. Variables of inner sections take precedence
+func (md *Markdown) EnvVars(cb *Codeblock) map[string]string {
+	envMap := map[string]string{}
+	sections := md.Sections()
+	for idx := sectionIndexAt(sections, cb.StartLine); idx != -1; idx = sections[idx].Parent {
+		sec := sections[idx]
+		for _, b := range md.blocks {
+			if b.language != "env" || b.start <= sec.Line || b.end >= sec.End {
+				continue
+			}
+			for _, line := range strings.Split(b.text, "\n") {
+				kvSplit := strings.Split(line, "=")
+				if len(kvSplit) != 2 {
+					continue
+				}
+
+				key := strings.Trim(kvSplit[0], " ")
+				val := strings.Trim(kvSplit[1], " ")
+
+				if _, ok := envMap[key]; !ok {
+					envMap[key] = val
+				}
+			}
+		}
+	}
+	return envMap
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// blockRange is where a codeblock starts and ends
+type blockRange struct {
+	start, end int
+}
+
+func blockRanges(md *Markdown) []blockRange {
+	ranges := []blockRange{}
+	for _, b := range md.blocks {
+		ranges = append(ranges, blockRange{b.start, b.end})
+	}
+	return ranges
+}
+
+func TestParseMarkdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []string
+		blocks   []blockRange
+		headings []Heading
+		unclosed int
+	}{
+		{
+			name:     "blocks and headings",
+			lines:    []string{"# Title", "```sh", "# not a heading", "```", "## Sub #", "~~~", "```", "~~~"},
+			blocks:   []blockRange{{1, 3}, {5, 7}},
+			headings: []Heading{{Line: 0, Level: 1, Text: "Title"}, {Line: 4, Level: 2, Text: "Sub"}},
+			unclosed: -1,
+		},
+		{
+			name:     "longer fence around fences",
+			lines:    []string{"````md", "```sh", "```", "````"},
+			blocks:   []blockRange{{0, 3}},
+			headings: []Heading{},
+			unclosed: -1,
+		},
+		{
+			name:     "unclosed fence",
+			lines:    []string{"```sh", "echo", "```", "", "```py", "# comment"},
+			blocks:   []blockRange{{0, 2}},
+			headings: []Heading{},
+			unclosed: 4,
+		},
+		{
+			name:     "indented code isn't a fence",
+			lines:    []string{"text", "", "    ```", "    code", "    ```"},
+			blocks:   []blockRange{},
+			headings: []Heading{},
+			unclosed: -1,
+		},
+		{
+			name:     "fences in list items",
+			lines:    []string{"- item", "", "  ```sh", "  echo", "  ```", "1.  item", "    ```sh", "    echo", "    ```"},
+			blocks:   []blockRange{{2, 4}, {6, 8}},
+			headings: []Heading{},
+			unclosed: -1,
+		},
+		{
+			name:     "list item ends at less indented line",
+			lines:    []string{"1.  item", "", "text", "    ```sh", "    ```"},
+			blocks:   []blockRange{},
+			headings: []Heading{},
+			unclosed: -1,
+		},
+		{
+			name:     "lazy continuation line stays in list item",
+			lines:    []string{"1.  item", "text", "    ```sh", "    ```"},
+			blocks:   []blockRange{{2, 3}},
+			headings: []Heading{},
+			unclosed: -1,
+		},
+		{
+			name:     "fences after list markers and in quotes are left out",
+			lines:    []string{"- ```sh", "  echo", "  ```", "", "> ```sh", "> echo", "> ```"},
+			blocks:   []blockRange{},
+			headings: []Heading{},
+			unclosed: -1,
+		},
+		{
+			name:     "fence closed by the end of its list item",
+			lines:    []string{"- item", "  ```sh", "", "text", "```sh", "```"},
+			blocks:   []blockRange{{4, 5}},
+			headings: []Heading{},
+			unclosed: 1,
+		},
+		{
+			name:     "invalid headings",
+			lines:    []string{"#hashtag", "####### seven", "    # indented", "#"},
+			blocks:   []blockRange{},
+			headings: []Heading{{Line: 3, Level: 1, Text: ""}},
+			unclosed: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := ParseMarkdown(tt.lines)
+			if got := blockRanges(md); !reflect.DeepEqual(got, tt.blocks) {
+				t.Errorf("blocks = %v, want %v", got, tt.blocks)
+			}
+			if got := md.Headings(); !reflect.DeepEqual(got, tt.headings) {
+				t.Errorf("headings = %v, want %v", got, tt.headings)
+			}
+			unclosed := -1
+			if md.unclosed != nil {
+				unclosed = md.unclosed.Line
+			}
+			if unclosed != tt.unclosed {
+				t.Errorf("unclosed fence at %d, want %d", unclosed, tt.unclosed)
+			}
+		})
+	}
+}
+
+func TestCodeblocksText(t *testing.T) {
+	md := ParseMarkdown([]string{"- item", "  ```python ID=1", "  if x:", "      y()", "", "  ```"})
+	cbs, err := md.Codeblocks(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cbs) != 1 {
+		t.Fatalf("got %d codeblocks, want 1", len(cbs))
+	}
+	cb := cbs[0]
+	if cb.Language != "python" || cb.Opts[CbOptID] != "1" {
+		t.Errorf("language %q and opts %v", cb.Language, cb.Opts)
+	}
+	if want := "if x:\n    y()\n\n"; cb.Text != want {
+		t.Errorf("text = %q, want %q", cb.Text, want)
+	}
+
+	if _, err := ParseMarkdown([]string{"```sh"}).Codeblocks(nil); err == nil {
+		t.Error("expected an error for an unclosed fence")
+	}
+}
+
+// assertSameMarkdown fails when edited doesn't match a full parse of its lines
+func assertSameMarkdown(t *testing.T, edited *Markdown, context string) {
+	t.Helper()
+	full := ParseMarkdown(edited.lines)
+	if !reflect.DeepEqual(blockRanges(edited), blockRanges(full)) {
+		t.Fatalf("%s: blocks %v, full parse %v", context, blockRanges(edited), blockRanges(full))
+	}
+	for i := range full.blocks {
+		if !reflect.DeepEqual(edited.blocks[i], full.blocks[i]) {
+			t.Fatalf("%s: block %+v, full parse %+v", context, edited.blocks[i], full.blocks[i])
+		}
+	}
+	if !reflect.DeepEqual(edited.Headings(), full.Headings()) {
+		t.Fatalf("%s: headings %v, full parse %v", context, edited.Headings(), full.Headings())
+	}
+	if !reflect.DeepEqual(edited.unclosed, full.unclosed) {
+		t.Fatalf("%s: unclosed %v, full parse %v", context, edited.unclosed, full.unclosed)
+	}
+}
+
+func TestMarkdownEdit(t *testing.T) {
+	doc := []string{"# A", "", "```sh", "echo a", "```", "", "## B", "1.  item", "", "    ```py", "    x", "    ```", "", "text"}
+	tests := []struct {
+		name        string
+		first, last int
+		replacement []string
+		blocks      []blockRange
+	}{
+		{"insert above", 0, 0, []string{"new", ""}, []blockRange{{4, 6}, {11, 13}}},
+		{"edit in block", 3, 4, []string{"echo b", "echo c"}, []blockRange{{2, 5}, {10, 12}}},
+		{"remove closing fence", 11, 12, []string{}, []blockRange{{2, 4}}},
+		{"remove list item", 7, 8, []string{}, []blockRange{{2, 4}}},
+		{"narrower list item", 7, 8, []string{"- item"}, []blockRange{{2, 4}, {9, 11}}},
+		{"list item in front of the fence", 8, 9, []string{"- item"}, []blockRange{{2, 4}, {9, 11}}},
+		{"delete everything", 0, 14, []string{}, []blockRange{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := ParseMarkdown(doc)
+			edited := md.Edit(tt.first, tt.last, tt.replacement)
+			if got := blockRanges(edited); !reflect.DeepEqual(got, tt.blocks) {
+				t.Errorf("blocks = %v, want %v", got, tt.blocks)
+			}
+			assertSameMarkdown(t, edited, tt.name)
+			if !reflect.DeepEqual(md.Lines(), doc) {
+				t.Error("Edit changed the original")
+			}
+		})
+	}
+}
+
+func TestMarkdownEditRandom(t *testing.T) {
+	pool := []string{"", "text", "# h", "  ## h", "- item", "1. item", "  - nested", "```", "```sh", "  ```", "    ```", "~~~", "````", "    code", "\tcode", "> quote", "> ```", "- ```sh"}
+	r := rand.New(rand.NewSource(1))
+	randomLines := func(n int) []string {
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = pool[r.Intn(len(pool))]
+		}
+		return lines
+	}
+	for i := 0; i < 2000; i++ {
+		md := ParseMarkdown(randomLines(r.Intn(30)))
+		for j := 0; j < 10; j++ {
+			first := r.Intn(md.LineCount() + 1)
+			last := first + r.Intn(md.LineCount()-first+1)
+			replacement := randomLines(r.Intn(4))
+			before := md.Lines()
+			md = md.Edit(first, last, replacement)
+			assertSameMarkdown(t, md, fmt.Sprintf("replacing %d-%d of %q with %q", first, last, before, replacement))
+		}
+	}
+}
+
+func TestSections(t *testing.T) {
+	md := ParseMarkdown([]string{"intro", "# A", "## A1", "### A1a", "## A2", "# B"})
+	want := []Section{
+		{Heading: Heading{Line: 1, Level: 1, Text: "A"}, End: 2, Parent: -1},
+		{Heading: Heading{Line: 2, Level: 2, Text: "A1"}, End: 3, Parent: 0},
+		{Heading: Heading{Line: 3, Level: 3, Text: "A1a"}, End: 4, Parent: 1},
+		{Heading: Heading{Line: 4, Level: 2, Text: "A2"}, End: 5, Parent: 0},
+		{Heading: Heading{Line: 5, Level: 1, Text: "B"}, End: 6, Parent: -1},
+	}
+	if got := md.Sections(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Sections() = %+v, want %+v", got, want)
+	}
+
+	start, end, err := md.SectionRangeAt(3)
+	if err != nil || start != 3 || end != 4 {
+		t.Errorf("SectionRangeAt(3) = %d, %d, %v", start, end, err)
+	}
+	start, end, err = md.SectionRangeAt(2)
+	if err != nil || start != 2 || end != 4 {
+		t.Errorf("SectionRangeAt(2) = %d, %d, %v", start, end, err)
+	}
+	if _, _, err := md.SectionRangeAt(0); err == nil {
+		t.Error("expected an error above the first heading")
+	}
+}
+
+func TestEnvVars(t *testing.T) {
+	md := ParseMarkdown([]string{
+		"# A",
+		"```env", "X=outer", "Y=outer", "```",
+		"## B",
+		"```env", "X=inner", "```",
+		"```sh", "echo $X $Y", "```",
+		"## C",
+		"```sh", "echo $X", "```",
+	})
+	cbs, err := md.Codeblocks(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := md.EnvVars(cbs[2]), map[string]string{"X": "inner", "Y": "outer"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("EnvVars in B = %v, want %v", got, want)
+	}
+	if got, want := md.EnvVars(cbs[3]), map[string]string{"X": "outer", "Y": "outer"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("EnvVars in C = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/mrWinston/mdrun.nvim/pkg/runner"
+	"github.com/samber/lo"
+)
+
+// NormalizeRule replaces every match of Pattern in a line of output with
+// Replace. Replace can refer to submatches like $1, a literal $ is written
+// as $$
+type NormalizeRule struct {
+	Pattern string `json:"pattern" yaml:"pattern"`
+	Replace string `json:"replace" yaml:"replace"`
+}
+
+// Normalizer applies normalize rules to output, so output that only differs
+// in e.g. temp paths, timestamps or pids is written the same way
+type Normalizer struct {
+	patterns     []*regexp.Regexp
+	replacements []string
+}
+
+// codeDirRule removes the temp dirs the code is written to from paths, so
+// e.g. tracebacks only show the name of the code file
+func codeDirRule() NormalizeRule {
+	return NormalizeRule{
+		Pattern: regexp.QuoteMeta(runner.CodeDirRoot()+"/") + `[^/\s]+/`,
+		Replace: "",
+	}
+}
+
+// Normalizer returns the normalizer for the output of the codeblock. It
+// removes the code dir from paths and applies the global normalize rules,
+// followed by the named rules listed in the NORMALIZE option of the codeblock
+func (c *Config) Normalizer(cb *Codeblock) (*Normalizer, error) {
+	rules := append([]NormalizeRule{codeDirRule()}, c.Normalize...)
+	names := lo.Compact(lo.Map(strings.Split(cb.Opts[CbOptNormalize], ","), func(name string, _ int) string {
+		return strings.TrimSpace(name)
+	}))
+	for _, name := range names {
+		named, ok := c.NormalizeRules[name]
+		if !ok {
+			return nil, fmt.Errorf("No normalize rules named '%s'", name)
+		}
+		rules = append(rules, named...)
+	}
+
+	n := &Normalizer{}
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid normalize pattern '%s': %w", rule.Pattern, err)
+		}
+		n.patterns = append(n.patterns, re)
+		n.replacements = append(n.replacements, rule.Replace)
+	}
+	return n, nil
+}
+
+// Empty returns whether the normalizer has no rules
+func (n *Normalizer) Empty() bool {
+	return len(n.patterns) == 0
+}
+
+// Apply returns text with the rules applied to every line, one after the
+// other. Lines are never added or removed
+func (n *Normalizer) Apply(text string) string {
+	if n.Empty() {
+		return text
+	}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		for j, re := range n.patterns {
+			line = re.ReplaceAllString(line, n.replacements[j])
+		}
+		// a rule replacing with a newline would move the following lines
+		lines[i] = strings.ReplaceAll(line, "\n", " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// clampHighlights fits highlights into the lines of text, whose length may
+// have changed since they were created
+func clampHighlights(highlights []Highlight, text string) []Highlight {
+	lines := strings.Split(text, "\n")
+	clamped := []Highlight{}
+	for _, h := range highlights {
+		if h.Line >= len(lines) {
+			continue
+		}
+		h.EndCol = min(h.EndCol, len(lines[h.Line]))
+		if h.StartCol >= h.EndCol {
+			continue
+		}
+		clamped = append(clamped, h)
+	}
+	return clamped
+}
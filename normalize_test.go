@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mrWinston/mdrun.nvim/pkg/runner"
+)
+
+func TestNormalizer(t *testing.T) {
+	config := &Config{
+		Normalize: []NormalizeRule{
+			{Pattern: `pid \d+`, Replace: "pid <pid>"},
+		},
+		NormalizeRules: map[string][]NormalizeRule{
+			"timing": {
+				{Pattern: `\d+(\.\d+)?m?s\b`, Replace: "<duration>"},
+			},
+			"money": {
+				{Pattern: `(\d+) EUR`, Replace: "$$$1"},
+			},
+			"lines": {
+				{Pattern: `x`, Replace: "\n"},
+			},
+		},
+	}
+	codeDir := runner.CodeDirRoot() + "/mdrun123/"
+
+	tests := []struct {
+		name      string
+		normalize string
+		text      string
+		want      string
+	}{
+		{"global rules", "", "pid 123 took 5ms\n", "pid <pid> took 5ms\n"},
+		{"named rules", "timing", "pid 123 took 5ms\n", "pid <pid> took <duration>\n"},
+		{"several named rules", "timing, money", "5 EUR in 1.5s", "$5 in <duration>"},
+		{"every line", "timing", "1s\n2s\n3s", "<duration>\n<duration>\n<duration>"},
+		{"newlines aren't added", "lines", "axb\nc", "a b\nc"},
+		{"code dir", "", `File "` + codeDir + `main.py", line 3`, `File "main.py", line 3`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := &Codeblock{Opts: map[string]string{}}
+			if tt.normalize != "" {
+				cb.Opts[CbOptNormalize] = tt.normalize
+			}
+			normalizer, err := config.Normalizer(cb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := normalizer.Apply(tt.text); got != tt.want {
+				t.Errorf("Apply(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizerErrors(t *testing.T) {
+	config := &Config{NormalizeRules: map[string][]NormalizeRule{
+		"broken": {{Pattern: `(`}},
+	}}
+	for _, normalize := range []string{"missing", "broken"} {
+		cb := &Codeblock{Opts: map[string]string{CbOptNormalize: normalize}}
+		if _, err := config.Normalizer(cb); err == nil {
+			t.Errorf("expected an error for NORMALIZE=%s", normalize)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/neovim/go-client/nvim"
+	log "github.com/sirupsen/logrus"
+)
+
+// NvimEditor is the Editor implementation for neovim
+type NvimEditor struct {
+	V *nvim.Nvim
+}
+
+// NewNvimEditor wraps the neovim client
+func NewNvimEditor(v *nvim.Nvim) *NvimEditor {
+	return &NvimEditor{V: v}
+}
+
+func (e *NvimEditor) ExecLua(code string, result any, args ...any) error {
+	return e.V.ExecLua(code, result, args...)
+}
+
+func (e *NvimEditor) CurrentDocument() (Document, error) {
+	buf, err := e.V.CurrentBuffer()
+	if err != nil {
+		return nil, err
+	}
+	return NewNvimDocument(e.V, buf), nil
+}
+
+func (e *NvimEditor) CursorLine() (int, error) {
+	currentWindow, err := e.V.CurrentWindow()
+	if err != nil {
+		return 0, err
+	}
+	cursorPosition, err := e.V.WindowCursor(currentWindow)
+	if err != nil {
+		return 0, err
+	}
+	return cursorPosition[0] - 1, nil
+}
+
+func (e *NvimEditor) Notify(level log.Level, msg string) error {
+	nvimLevel := nvim.LogInfoLevel
+	switch {
+	case level <= log.ErrorLevel:
+		nvimLevel = nvim.LogErrorLevel
+	case level == log.WarnLevel:
+		nvimLevel = nvim.LogWarnLevel
+	case level >= log.DebugLevel:
+		nvimLevel = nvim.LogDebugLevel
+	}
+	return e.V.Notify(msg, nvimLevel, map[string]any{})
+}
+
+// NvimDocument is a neovim buffer. Its lines are read from the copy kept up to
+// date by the buffer events
+type NvimDocument struct {
+	V      *nvim.Nvim
+	Buffer nvim.Buffer
+}
+
+// NewNvimDocument returns the document for the given buffer
+func NewNvimDocument(v *nvim.Nvim, buf nvim.Buffer) *NvimDocument {
+	return &NvimDocument{
+		V:      v,
+		Buffer: buf,
+	}
+}
+
+func (d *NvimDocument) ID() int {
+	return int(d.Buffer)
+}
+
+func (d *NvimDocument) Path() string {
+	name, err := d.V.BufferName(d.Buffer)
+	if err != nil {
+		log.Errorf("Couldn't get name of buffer %d: %v", d.Buffer, err)
+		return ""
+	}
+	return name
+}
+
+func (d *NvimDocument) Lines() ([]string, error) {
+	lines, ok := GetBufferLines(d.Buffer)
+	if !ok {
+		return nil, fmt.Errorf("No Buffer lines for buffer %d", d.Buffer)
+	}
+	return lines, nil
+}
+
+func (d *NvimDocument) Markdown() (*Markdown, error) {
+	md, ok := GetBufferMarkdown(d.Buffer)
+	if !ok {
+		return nil, fmt.Errorf("No Buffer lines for buffer %d", d.Buffer)
+	}
+	return md, nil
+}
+
+func (d *NvimDocument) SetLines(start int, end int, lines [][]byte) error {
+	return NvimSetBufferLines(d.V, d.Buffer, start, end, lines)
+}
+
+func (d *NvimDocument) SetStatus(line int, id int, status string, highlight string) error {
+	namespaceID, err := d.V.CreateNamespace(ExtmarkNs)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.V.SetBufferExtmark(d.Buffer, namespaceID, line, 0, map[string]any{
+		"id":        id,
+		"virt_text": [][]any{{status, highlight}},
+	})
+	return err
+}
+
+func (d *NvimDocument) SetVirtualLines(line int, id int, lines []string, highlight string) error {
+	namespaceID, err := d.V.CreateNamespace(ExtmarkNs)
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		_, err = d.V.DeleteBufferExtmark(d.Buffer, namespaceID, id)
+		return err
+	}
+
+	virtLines := [][][]any{}
+	for _, l := range lines {
+		virtLines = append(virtLines, [][]any{{l, highlight}})
+	}
+	_, err = d.V.SetBufferExtmark(d.Buffer, namespaceID, line, 0, map[string]any{
+		"id":         id,
+		"virt_lines": virtLines,
+	})
+	return err
+}
+
+// setDiagnosticsLua replaces the diagnostics of one codeblock. The others
+// are taken from vim.diagnostic, which keeps them where their lines moved
+const setDiagnosticsLua = `
+local buf, ns_name, id, diagnostics = ...
+local ns = vim.api.nvim_create_namespace(ns_name)
+local all = {}
+for _, d in ipairs(vim.diagnostic.get(buf, { namespace = ns })) do
+  if not (d.user_data and d.user_data.mdrun_id == id) then
+    table.insert(all, d)
+  end
+end
+for _, d in ipairs(diagnostics) do
+  table.insert(all, {
+    lnum = d[1],
+    col = d[2],
+    severity = vim.diagnostic.severity[d[3]],
+    message = d[4],
+    source = "mdrun",
+    user_data = { mdrun_id = id },
+  })
+end
+vim.diagnostic.set(ns, buf, all)
+`
+
+func (d *NvimDocument) SetDiagnostics(id string, diagnostics []Diagnostic) error {
+	list := [][]any{}
+	for _, diagnostic := range diagnostics {
+		list = append(list, []any{diagnostic.Line, diagnostic.Col, diagnostic.Severity, diagnostic.Message})
+	}
+	return d.V.ExecLua(setDiagnosticsLua, nil, int(d.Buffer), DiagnosticNs, id, list)
+}
+
+// setHighlightsLua removes the highlights in a range of lines and adds new
+// ones. Status marks in the same namespace are kept
+const setHighlightsLua = `
+local buf, ns_name, start, stop, groups, highlights = ...
+local ns = vim.api.nvim_create_namespace(ns_name)
+for name, attrs in pairs(groups) do
+  vim.api.nvim_set_hl(0, name, attrs)
+end
+if stop > start then
+  local marks = vim.api.nvim_buf_get_extmarks(buf, ns, { start, 0 }, { stop - 1, -1 }, { details = true })
+  for _, mark in ipairs(marks) do
+    if mark[4].hl_group then
+      vim.api.nvim_buf_del_extmark(buf, ns, mark[1])
+    end
+  end
+end
+for _, h in ipairs(highlights) do
+  vim.api.nvim_buf_set_extmark(buf, ns, h[1], h[2], { end_row = h[1], end_col = h[3], hl_group = h[4] })
+end
+`
+
+func (d *NvimDocument) SetHighlights(start int, end int, highlights []Highlight) error {
+	groups := map[string]map[string]any{}
+	marks := [][]any{}
+	for _, h := range highlights {
+		group := h.Link
+		if group == "" {
+			group = h.Style.HighlightGroup()
+			groups[group] = h.Style.HighlightAttrs()
+		}
+		marks = append(marks, []any{h.Line, h.StartCol, h.EndCol, group})
+	}
+	return d.V.ExecLua(setHighlightsLua, nil, int(d.Buffer), ExtmarkNs, start, end, groups, marks)
+}
+
+// SetAnchor sets an extmark spanning the lines. Its end moves along with text
+// inserted in front of the last line, so lines added at the end of a
+// codeblock stay inside of it
+func (d *NvimDocument) SetAnchor(id int, start int, end int) error {
+	namespaceID, err := d.V.CreateNamespace(ExtmarkNs)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.V.SetBufferExtmark(d.Buffer, namespaceID, start, 0, map[string]any{
+		"id":                id,
+		"end_row":           end,
+		"end_col":           0,
+		"end_right_gravity": true,
+	})
+	return err
+}
+
+// anchorLua returns the start and end row of an extmark, nothing when it
+// doesn't exist
+const anchorLua = `
+local buf, ns_name, id = ...
+local ns = vim.api.nvim_create_namespace(ns_name)
+local mark = vim.api.nvim_buf_get_extmark_by_id(buf, ns, id, { details = true })
+if #mark == 0 then
+  return nil
+end
+return { mark[1], mark[3].end_row or mark[1] }
+`
+
+func (d *NvimDocument) Anchor(id int) (int, int, bool, error) {
+	var rows []int
+	if err := d.V.ExecLua(anchorLua, &rows, int(d.Buffer), ExtmarkNs, id); err != nil {
+		return 0, 0, false, err
+	}
+	if len(rows) != 2 {
+		return 0, 0, false, nil
+	}
+	return rows[0], rows[1], true, nil
+}
+
+func (d *NvimDocument) RemoveAnchor(id int) error {
+	namespaceID, err := d.V.CreateNamespace(ExtmarkNs)
+	if err != nil {
+		return err
+	}
+	_, err = d.V.DeleteBufferExtmark(d.Buffer, namespaceID, id)
+	return err
+}
@@ -2,12 +2,9 @@ package runner
 
 import (
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
 	"path"
-
-	"github.com/neovim/go-client/nvim"
 )
 
 //go:generate gomodifytags -file $GOFILE -all -add-tags "json,yaml" -transform snakecase -override -w -quiet
@@ -17,27 +14,27 @@ type CompiledRunner struct {
 	FileName   string `json:"file_name" yaml:"file_name"`
 }
 
-func (cr *CompiledRunner) CreateCommand(v *nvim.Nvim, code string, opts map[string]string, envVars map[string]string) (*exec.Cmd, error) {
-	tmpDirPath, err := os.MkdirTemp(os.TempDir(), "mdrun")
+func (cr *CompiledRunner) SourceFileName() string {
+	return cr.FileName
+}
+
+func (cr *CompiledRunner) CreateCommand(e Editor, code string, opts map[string]string, envVars map[string]string) (*exec.Cmd, error) {
+	tmpDirPath, err := CodeDir(opts, "mdrun")
 	if err != nil {
 		return nil, err
 	}
 	executableName := "main"
 	sourcePath := path.Join(tmpDirPath, cr.FileName)
 
-	sourceFile, err := os.Create(sourcePath)
-	if err != nil {
-		return nil, err
-	}
-
-	if _, err = io.WriteString(sourceFile, code); err != nil {
+	if err := os.WriteFile(sourcePath, []byte(code), 0644); err != nil {
 		return nil, err
 	}
 
-	compileCommandString := fmt.Sprintf("%s %s ./%s ./%s", cr.Compiler, cr.OutputFlag, executableName, cr.FileName)
+	// compiling in the code dir keeps the paths in error messages short
+	compileCommandString := fmt.Sprintf("cd '%s' && %s %s ./%s ./%s", tmpDirPath, cr.Compiler, cr.OutputFlag, executableName, cr.FileName)
 
-	runCommand := exec.Command("sh", "-c", fmt.Sprintf("%s && ./%s", compileCommandString, executableName))
-	runCommand.Dir = tmpDirPath
+	runCommand := exec.Command("sh", "-c", fmt.Sprintf("(%s) && '%s'", compileCommandString, path.Join(tmpDirPath, executableName)))
+	runCommand.Dir = Workdir(opts)
 	runCommand.Env = CreateEnvArray(envVars)
 
 	return runCommand, nil
@@ -2,16 +2,27 @@ package runner
 
 import (
 	"os/exec"
+)
 
-	"github.com/neovim/go-client/nvim"
+// DefaultGoRepl and DefaultGoReplEcho are used for sessions when a GoRunner
+// doesn't configure repl and repl_echo, as go itself doesn't have a repl
+const (
+	DefaultGoRepl     = "gomacro -s"
+	DefaultGoReplEcho = "println(%q)"
 )
 
 //go:generate gomodifytags -file $GOFILE -all -add-tags "json,yaml" -transform snakecase -override -w -quiet
 type GoRunner struct {
-	UseGomacro bool `json:"use_gomacro" yaml:"use_gomacro"`
+	UseGomacro bool   `json:"use_gomacro" yaml:"use_gomacro"`
+	Repl       string `json:"repl" yaml:"repl"`
+	ReplEcho   string `json:"repl_echo" yaml:"repl_echo"`
+}
+
+func (gr *GoRunner) SourceFileName() string {
+	return "main.go"
 }
 
-func (gr *GoRunner) CreateCommand(v *nvim.Nvim, code string, opts map[string]string, envVars map[string]string) (*exec.Cmd, error) {
+func (gr *GoRunner) CreateCommand(e Editor, code string, opts map[string]string, envVars map[string]string) (*exec.Cmd, error) {
 	interpreter := ""
 	if gr.UseGomacro {
 		interpreter = "gomacro"
@@ -21,7 +32,30 @@ func (gr *GoRunner) CreateCommand(v *nvim.Nvim, code string, opts map[string]str
 
 	cmd := &InterpretedRunner{
 		Interpreter: interpreter,
-		FileName:    "main.go",
+		FileName:    gr.SourceFileName(),
+	}
+	return cmd.CreateCommand(e, code, opts, envVars)
+}
+
+func (gr *GoRunner) replRunner() *InterpretedRunner {
+	repl := &InterpretedRunner{
+		Repl:     gr.Repl,
+		ReplEcho: gr.ReplEcho,
 	}
-	return cmd.CreateCommand(v, code, opts, envVars)
+	if repl.Repl == "" {
+		repl.Repl = DefaultGoRepl
+	}
+	if repl.ReplEcho == "" {
+		repl.ReplEcho = DefaultGoReplEcho
+	}
+	return repl
+}
+
+// CreateReplCommand starts the configured repl, gomacro by default
+func (gr *GoRunner) CreateReplCommand(e Editor, envVars map[string]string) (*exec.Cmd, error) {
+	return gr.replRunner().CreateReplCommand(e, envVars)
+}
+
+func (gr *GoRunner) ReplInput(code string, startMarker string, endMarker string) string {
+	return gr.replRunner().ReplInput(code, startMarker, endMarker)
 }
@@ -1,24 +1,34 @@
 package runner
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
 	"path"
 	"strings"
-
-	"github.com/neovim/go-client/nvim"
 )
 
+// DefaultReplEcho is used to print the session markers when an
+// InterpretedRunner doesn't configure repl_echo
+const DefaultReplEcho = "print(%q)"
+
 //go:generate gomodifytags -file $GOFILE -all -add-tags "json,yaml" -transform snakecase -override -w -quiet
 type InterpretedRunner struct {
 	Interpreter string `json:"interpreter" yaml:"interpreter"`
 	FileName    string `json:"file_name" yaml:"file_name"`
+	Repl        string `json:"repl" yaml:"repl"`
+	ReplEcho    string `json:"repl_echo" yaml:"repl_echo"`
+	ReplExec    string `json:"repl_exec" yaml:"repl_exec"`
 }
 
-func (ir *InterpretedRunner) CreateCommand(v *nvim.Nvim, code string, opts map[string]string, envVars map[string]string) (*exec.Cmd, error) {
+func (ir *InterpretedRunner) SourceFileName() string {
+	return ir.FileName
+}
+
+func (ir *InterpretedRunner) CreateCommand(e Editor, code string, opts map[string]string, envVars map[string]string) (*exec.Cmd, error) {
 	var outCommand *exec.Cmd
 
-	tmpDirPath, err := os.MkdirTemp(os.TempDir(), "mdrun")
+	tmpDirPath, err := CodeDir(opts, "mdrun")
 	if err != nil {
 		return nil, err
 	}
@@ -26,11 +36,50 @@ func (ir *InterpretedRunner) CreateCommand(v *nvim.Nvim, code string, opts map[s
 	os.WriteFile(path.Join(tmpDirPath, ir.FileName), []byte(code), os.ModePerm)
 
 	inter := strings.Split(ir.Interpreter, " ")
-	inter = append(inter, "./"+ir.FileName)
+	inter = append(inter, path.Join(tmpDirPath, ir.FileName))
 
 	outCommand = exec.Command(inter[0], inter[1:]...)
 	outCommand.Env = CreateEnvArray(envVars)
-	outCommand.Dir = tmpDirPath
+	outCommand.Dir = Workdir(opts)
 
 	return outCommand, nil
 }
+
+// CreateReplCommand starts the configured repl through sh, so that it can
+// contain quoted arguments
+func (ir *InterpretedRunner) CreateReplCommand(e Editor, envVars map[string]string) (*exec.Cmd, error) {
+	if ir.Repl == "" {
+		return nil, fmt.Errorf("No repl configured for interpreter %s", ir.Interpreter)
+	}
+
+	outCommand := exec.Command("sh", "-c", ir.Repl)
+	outCommand.Env = CreateEnvArray(envVars)
+
+	return outCommand, nil
+}
+
+// ReplInput surrounds the code with calls to ReplEcho. With ReplExec, the
+// code is sent as a single statement that evaluates all of it, as
+// interpreters like python can't take blocks with blank lines or dedented
+// statements line by line. Otherwise the lines are sent as they are, and the
+// empty line after them closes any indented block that is still open
+func (ir *InterpretedRunner) ReplInput(code string, startMarker string, endMarker string) string {
+	echo := ir.ReplEcho
+	if echo == "" {
+		echo = DefaultReplEcho
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf(echo, startMarker))
+	sb.WriteString("\n")
+	if ir.ReplExec != "" {
+		sb.WriteString(fmt.Sprintf(ir.ReplExec, code))
+	} else {
+		sb.WriteString(strings.TrimRight(code, "\n"))
+	}
+	sb.WriteString("\n\n")
+	sb.WriteString(fmt.Sprintf(echo, endMarker))
+	sb.WriteString("\n")
+
+	return sb.String()
+}
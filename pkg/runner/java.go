@@ -3,8 +3,6 @@ package runner
 import (
 	"os/exec"
 	"strings"
-
-	"github.com/neovim/go-client/nvim"
 )
 
 //go:generate gomodifytags -file $GOFILE -all -add-tags "json,yaml" -transform snakecase -override -w -quiet
@@ -12,7 +10,11 @@ type JavaRunner struct {
 	UseJshell bool `json:"use_jshell" yaml:"use_jshell"`
 }
 
-func (jr *JavaRunner) CreateCommand(v *nvim.Nvim, code string, opts map[string]string, envVars map[string]string) (*exec.Cmd, error) {
+func (jr *JavaRunner) SourceFileName() string {
+	return "main.java"
+}
+
+func (jr *JavaRunner) CreateCommand(e Editor, code string, opts map[string]string, envVars map[string]string) (*exec.Cmd, error) {
 	interpreter := ""
 	if jr.UseJshell {
 		interpreter = "jshell"
@@ -25,8 +27,8 @@ func (jr *JavaRunner) CreateCommand(v *nvim.Nvim, code string, opts map[string]s
 	}
 	selectedRunner := &InterpretedRunner{
 		Interpreter: interpreter,
-		FileName:    "main.java",
+		FileName:    jr.SourceFileName(),
 	}
 
-	return selectedRunner.CreateCommand(v, code, opts, envVars)
+	return selectedRunner.CreateCommand(e, code, opts, envVars)
 }
@@ -3,8 +3,6 @@ package runner
 import (
 	"fmt"
 	"os/exec"
-
-	"github.com/neovim/go-client/nvim"
 )
 
 //go:generate gomodifytags -file $GOFILE -all -add-tags "json,yaml" -transform snakecase -override -w -quiet
@@ -16,10 +14,17 @@ const (
 	LUARUNNER_OPT_IN_NVIM = "IN_NVIM"
 )
 
-func (lu *LuaRunner) CreateCommand(v *nvim.Nvim, code string, opts map[string]string, envVars map[string]string) (*exec.Cmd, error) {
+func (lu *LuaRunner) SourceFileName() string {
+	return "main.lua"
+}
+
+func (lu *LuaRunner) CreateCommand(e Editor, code string, opts map[string]string, envVars map[string]string) (*exec.Cmd, error) {
 	if opts[LUARUNNER_OPT_IN_NVIM] == "true" {
+		if e == nil {
+			return nil, fmt.Errorf("%s=true needs a running neovim", LUARUNNER_OPT_IN_NVIM)
+		}
 		var execResult interface{}
-		err := v.ExecLua(code, execResult)
+		err := e.ExecLua(code, execResult)
 
 		if err != nil {
 			return exec.Command("/bin/sh", "-c", fmt.Sprintf("echo 'Got an error: %v'; exit 1", err)), nil
@@ -29,8 +34,8 @@ func (lu *LuaRunner) CreateCommand(v *nvim.Nvim, code string, opts map[string]st
 
 	runner := &InterpretedRunner{
 		Interpreter: "lua",
-		FileName:    "main.lua",
+		FileName:    lu.SourceFileName(),
 	}
 
-	return runner.CreateCommand(v, code, opts, envVars)
+	return runner.CreateCommand(e, code, opts, envVars)
 }
@@ -7,12 +7,44 @@ import (
 	"os/exec"
 	"path"
 	"strings"
+)
+
+// Editor is the editor that codeblocks are run from. It is nil when mdrun
+// runs without an editor
+type Editor interface {
+	ExecLua(code string, result any, args ...any) error
+}
 
-	"github.com/neovim/go-client/nvim"
+const (
+	// RUNNER_OPT_WORKDIR is the option holding the directory the command
+	// runs in. It is resolved to an absolute path before it's passed to a
+	// runner
+	RUNNER_OPT_WORKDIR = "CWD"
+	// RUNNER_OPT_CODE_DIR is the option holding the dir to write the code
+	// to. The caller removes it once the command has exited
+	RUNNER_OPT_CODE_DIR = "CODE_DIR"
 )
 
 type CodeblockRunner interface {
-	CreateCommand(v *nvim.Nvim, code string, opts map[string]string, envVars map[string]string) (*exec.Cmd, error)
+	CreateCommand(e Editor, code string, opts map[string]string, envVars map[string]string) (*exec.Cmd, error)
+}
+
+// ReplRunner is implemented by runners that can keep a long-lived interpreter
+// running, which is used for codeblocks that have a SESSION set
+type ReplRunner interface {
+	// CreateReplCommand creates the command that starts the interpreter
+	CreateReplCommand(e Editor, envVars map[string]string) (*exec.Cmd, error)
+	// ReplInput wraps code so that the interpreter prints startMarker before
+	// and endMarker after the output of code, each at the end of a line. The
+	// end marker follows output without a newline at its end on its line
+	ReplInput(code string, startMarker string, endMarker string) string
+}
+
+// SourceFileRunner is implemented by runners that write the code to a file
+// before running it. Error messages refer to lines of that file
+type SourceFileRunner interface {
+	// SourceFileName returns the name of the file the code is written to
+	SourceFileName() string
 }
 
 func CreateEnvArray(envVars map[string]string) []string {
@@ -25,10 +57,44 @@ func CreateEnvArray(envVars map[string]string) []string {
   return out
 }
 
+// CodeDirRoot is the directory that the temp dirs holding the code of
+// codeblocks are created in
+func CodeDirRoot() string {
+	return path.Join(os.TempDir(), "mdrun-code")
+}
+
+// NewCodeDir creates a temp dir in CodeDirRoot to write code to
+func NewCodeDir(pattern string) (string, error) {
+	root := CodeDirRoot()
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(root, pattern)
+}
+
+// CodeDir returns the dir to write the code to, which is taken from the
+// CODE_DIR option or created with NewCodeDir
+func CodeDir(opts map[string]string, pattern string) (string, error) {
+	if codeDir := opts[RUNNER_OPT_CODE_DIR]; codeDir != "" {
+		return codeDir, nil
+	}
+	return NewCodeDir(pattern)
+}
+
+// Workdir returns the directory the command should run in, taken from the
+// CWD option. It's empty when the command runs in a container
+func Workdir(opts map[string]string) string {
+	workdir := opts[RUNNER_OPT_WORKDIR]
+	if strings.HasPrefix(workdir, SHELLRUNNER_OPT_WORKDIR_DOCKER_PREFIX+":") {
+		return ""
+	}
+	return workdir
+}
+
 func CreateTmpFile(filename string, text string) (mainFilePath string, err error) {
   splitted := strings.Split(filename, ".")
   suffix := splitted[len(splitted) - 1]
-	tmpDirPath, err := os.MkdirTemp(os.TempDir(), "mdrun_" + suffix)
+	tmpDirPath, err := NewCodeDir("mdrun_" + suffix)
 	if err != nil {
 		return "", err
 	}
@@ -4,9 +4,8 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path"
 	"strings"
-
-	"github.com/neovim/go-client/nvim"
 )
 
 const (
@@ -20,11 +19,15 @@ type ShellRunner struct {
 	DefaultShell string `json:"default_shell" yaml:"default_shell"`
 }
 
-func (sh *ShellRunner) CreateCommand(v *nvim.Nvim, code string, opts map[string]string, envVars map[string]string) (*exec.Cmd, error) {
+func (sh *ShellRunner) CreateCommand(e Editor, code string, opts map[string]string, envVars map[string]string) (*exec.Cmd, error) {
 	var outCommand *exec.Cmd
 	var err error
 
-	tmpfile, err := os.CreateTemp(os.TempDir(), "granite.tmpfile")
+	codeDir, err := CodeDir(opts, "mdrun_sh")
+	if err != nil {
+		return nil, err
+	}
+	tmpfile, err := os.Create(path.Join(codeDir, "main.sh"))
 
 	if err != nil {
 		return nil, err
@@ -39,7 +42,7 @@ func (sh *ShellRunner) CreateCommand(v *nvim.Nvim, code string, opts map[string]
 	var shellCmd string
 	if strings.HasPrefix(
 		opts[SHELLRUNNER_OPT_WORKDIR],
-		SHELLRUNNER_OPT_WORKDIR_DOCKER_PREFIX,
+		SHELLRUNNER_OPT_WORKDIR_DOCKER_PREFIX+":",
 	) {
 		cwdSplit := strings.Split(opts[SHELLRUNNER_OPT_WORKDIR], ":")
 		if len(cwdSplit) != 2 {
@@ -71,6 +74,22 @@ func (sh *ShellRunner) CreateCommand(v *nvim.Nvim, code string, opts map[string]
 
 	outCommand = exec.Command(sh.DefaultShell, "-i", "-c", shellCmd)
 	outCommand.Env = CreateEnvArray(envVars)
+	outCommand.Dir = Workdir(opts)
 
 	return outCommand, nil
 }
+
+// CreateReplCommand starts the default shell reading commands from stdin
+func (sh *ShellRunner) CreateReplCommand(e Editor, envVars map[string]string) (*exec.Cmd, error) {
+	outCommand := exec.Command(sh.DefaultShell)
+	outCommand.Env = CreateEnvArray(envVars)
+
+	return outCommand, nil
+}
+
+// ReplInput surrounds the code with echo commands for the markers. The trap
+// keeps the shell alive when the session is interrupted. Commands it runs
+// don't inherit it, so they still stop on SIGINT
+func (sh *ShellRunner) ReplInput(code string, startMarker string, endMarker string) string {
+	return fmt.Sprintf("trap : INT\necho '%s'\n%s\necho '%s'\n", startMarker, strings.TrimRight(code, "\n"), endMarker)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultPtySize is the terminal size used when pty_size isn't configured
+const DefaultPtySize = "80x24"
+
+// ParsePtySize parses a terminal size given as COLUMNSxROWS, e.g. 120x40
+func ParsePtySize(size string) (*pty.Winsize, error) {
+	cols, rows, ok := strings.Cut(strings.ToLower(size), "x")
+	if !ok {
+		return nil, fmt.Errorf("Invalid pty size '%s', expected COLUMNSxROWS", size)
+	}
+	c, err := strconv.ParseUint(cols, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid columns in pty size '%s': %w", size, err)
+	}
+	r, err := strconv.ParseUint(rows, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid rows in pty size '%s': %w", size, err)
+	}
+	return &pty.Winsize{Cols: uint16(c), Rows: uint16(r)}, nil
+}
+
+// TerminalSize returns the terminal size for the codeblock, or nil when it
+// doesn't run in a pseudo terminal. PTY=true or the pty setting of the
+// runner enable it, PTY_SIZE or pty_size set the size
+func (c *Config) TerminalSize(cb *Codeblock) (*pty.Winsize, error) {
+	enabled := false
+	if rc := c.FindRunnerConfig(cb.Language); rc != nil {
+		enabled = rc.Pty
+	}
+	if opt, ok := cb.Opts[CbOptPty]; ok {
+		enabled = opt == "true"
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	size := DefaultPtySize
+	if c.PtySize != "" {
+		size = c.PtySize
+	}
+	if opt, ok := cb.Opts[CbOptPtySize]; ok {
+		size = opt
+	}
+	return ParsePtySize(size)
+}
+
+// startInPty starts cmd with a new pseudo terminal of the given size as its
+// stdin, stdout and stderr. The terminal doesn't translate newlines, so the
+// output only contains the carriage returns the command printed itself.
+// Returns the controlling side of the terminal, which has to be closed once
+// the command has finished
+func startInPty(cmd *exec.Cmd, size *pty.Winsize) (*os.File, error) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't open pty: %w", err)
+	}
+	defer tty.Close()
+
+	err = pty.Setsize(ptmx, size)
+	if err != nil {
+		ptmx.Close()
+		return nil, fmt.Errorf("Couldn't set pty size: %w", err)
+	}
+
+	termios, err := unix.IoctlGetTermios(int(tty.Fd()), ioctlGetTermios)
+	if err != nil {
+		ptmx.Close()
+		return nil, fmt.Errorf("Couldn't get pty attributes: %w", err)
+	}
+	termios.Oflag &^= unix.ONLCR
+	err = unix.IoctlSetTermios(int(tty.Fd()), ioctlSetTermios, termios)
+	if err != nil {
+		ptmx.Close()
+		return nil, fmt.Errorf("Couldn't set pty attributes: %w", err)
+	}
+
+	cmd.Stdin = tty
+	cmd.Stdout = tty
+	cmd.Stderr = tty
+	// the command gets its own session with the pty as controlling terminal.
+	// Its process group id is its pid, like with Setpgid
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+
+	err = cmd.Start()
+	if err != nil {
+		ptmx.Close()
+		return nil, err
+	}
+	return ptmx, nil
+}
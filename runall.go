@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// RunScopeBuffer runs all codeblocks of the document
+	RunScopeBuffer = "buffer"
+	// RunScopeSection runs all codeblocks of the heading section containing
+	// the cursor, including its subsections
+	RunScopeSection = "section"
+	// RunScopeBelow runs the codeblock under the cursor and all codeblocks
+	// after it
+	RunScopeBelow = "below"
+)
+
+// RunAllResult is the outcome of a single codeblock run by RunAll
+type RunAllResult struct {
+	Ref string
+	Err error
+	// NotRun is set for codeblocks after a failure that weren't started
+	NotRun bool
+}
+
+// CodeblocksInScope returns the runnable codeblocks of the current document
+// in the given scope
+func CodeblocksInScope(e Editor, scope string) ([]*Codeblock, error) {
+	doc, err := e.CurrentDocument()
+	if err != nil {
+		return nil, err
+	}
+	md, err := doc.Markdown()
+	if err != nil {
+		return nil, err
+	}
+	codeblocks, err := md.Codeblocks(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	first, last := 0, md.LineCount()
+	switch scope {
+	case RunScopeBuffer:
+	case RunScopeSection:
+		cursor, err := e.CursorLine()
+		if err != nil {
+			return nil, err
+		}
+		first, last, err = md.SectionRangeAt(cursor)
+		if err != nil {
+			return nil, err
+		}
+	case RunScopeBelow:
+		first, err = e.CursorLine()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown scope '%s', expected one of %s, %s, %s", scope, RunScopeBuffer, RunScopeSection, RunScopeBelow)
+	}
+
+	return lo.Filter(codeblocks, func(cb *Codeblock, _ int) bool {
+		return cb.EndLine >= first && cb.StartLine < last && IsRunnable(cb)
+	}), nil
+}
+
+// RunAll runs the runnable codeblocks of the current document in the given
+// scope one after the other, waiting for each to finish. Unless
+// continueOnError is set, it stops at the first codeblock that fails. A
+// summary is shown in the editor when all codeblocks are done
+func RunAll(e Editor, scope string, continueOnError bool) ([]RunAllResult, error) {
+	doc, err := e.CurrentDocument()
+	if err != nil {
+		return nil, err
+	}
+	fixDuplicateIDs(e, doc)
+
+	codeblocks, err := CodeblocksInScope(e, scope)
+	if err != nil {
+		return nil, err
+	}
+	if len(codeblocks) == 0 {
+		e.Notify(log.InfoLevel, "mdrun: no codeblocks to run")
+		return nil, nil
+	}
+
+	// running a codeblock moves all codeblocks after it when its out block is
+	// created, so they are looked up again by id before they run
+	ids := []string{}
+	for _, cb := range codeblocks {
+		if err := EnsureID(cb); err != nil {
+			return nil, err
+		}
+		ids = append(ids, cb.GetID())
+	}
+
+	results := []RunAllResult{}
+	failed := false
+	for _, id := range ids {
+		cb, err := FindCodeblockByOpt(CbOptID, id, doc)
+		if err == nil && cb == nil {
+			err = fmt.Errorf("Codeblock %s was removed", id)
+		}
+		ref := id
+		if cb != nil {
+			ref = cb.Ref()
+		}
+		if failed && !continueOnError {
+			results = append(results, RunAllResult{Ref: ref, NotRun: true})
+			continue
+		}
+		if err != nil {
+			results = append(results, RunAllResult{Ref: ref, Err: err})
+			failed = true
+			continue
+		}
+
+		log.Infof("Running %s", ref)
+		done, err := RunWithDependencies(e, cb)
+		if err == nil {
+			err = <-done
+		}
+		results = append(results, RunAllResult{Ref: ref, Err: err})
+		if err != nil {
+			failed = true
+		}
+	}
+
+	level := log.InfoLevel
+	if failed {
+		level = log.ErrorLevel
+	}
+	if err := e.Notify(level, FormatRunAllSummary(results)); err != nil {
+		log.Errorf("Couldn't show summary: %v", err)
+	}
+	return results, nil
+}
+
+// FormatRunAllSummary lists which codeblocks passed and which failed
+func FormatRunAllSummary(results []RunAllResult) string {
+	passed, failed, notRun := 0, 0, 0
+	lines := []string{}
+	for _, r := range results {
+		switch {
+		case r.NotRun:
+			notRun++
+			lines = append(lines, fmt.Sprintf("  - %s: not run", r.Ref))
+		case r.Err != nil:
+			failed++
+			lines = append(lines, fmt.Sprintf("  %s %s: %v", errorGlyph, r.Ref, r.Err))
+		default:
+			passed++
+			lines = append(lines, fmt.Sprintf("  %s %s", checkmarkGlyph, r.Ref))
+		}
+	}
+
+	header := fmt.Sprintf("mdrun: %d passed, %d failed", passed, failed)
+	if notRun > 0 {
+		header += fmt.Sprintf(", %d not run", notRun)
+	}
+	return strings.Join(append([]string{header}, lines...), "\n")
+}
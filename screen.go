@@ -0,0 +1,303 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	escByte = 0x1b
+	belByte = 0x07
+)
+
+// screenCell is a single character on the screen. prefix holds the zero
+// width escape sequences, like colors, that were written right before it.
+// stderr is set when the character was written to stderr
+type screenCell struct {
+	prefix string
+	char   rune
+	stderr bool
+}
+
+// screenLine is a line of the screen. tail holds escape sequences written
+// after the last character of the line
+type screenLine struct {
+	cells []screenCell
+	tail  string
+}
+
+// Screen is a small VT100 style terminal that output is written to. It
+// interprets carriage returns, backspaces, cursor movement and erase
+// sequences, so the text shows what a terminal would show instead of every
+// intermediate state of e.g. a progress bar. Unlike a terminal, the screen
+// has no height and never scrolls. Color sequences are kept as they are
+type Screen struct {
+	lines []screenLine
+	row   int
+	col   int
+	// pending holds escape sequences that are attached to the next character
+	pending string
+	// partial and stderrPartial hold an incomplete escape sequence or utf8
+	// character from the end of the last write to stdout and stderr
+	partial       []byte
+	stderrPartial []byte
+	// stderr is set while output of stderr is interpreted
+	stderr bool
+}
+
+// NewScreen returns an empty screen with the cursor in the top left corner
+func NewScreen() *Screen {
+	return &Screen{
+		lines: []screenLine{{}},
+	}
+}
+
+// RenderTerminalOutput returns what the output would look like on a terminal
+func RenderTerminalOutput(output string) string {
+	screen := NewScreen()
+	screen.Write([]byte(output))
+	return screen.String()
+}
+
+// Write interprets the output at the cursor position. Escape sequences and
+// characters split across writes are completed by the next write
+func (s *Screen) Write(p []byte) (int, error) {
+	return s.write(p, &s.partial, false)
+}
+
+// WriteStderr is like Write, but the characters are marked as stderr output,
+// see StderrLines
+func (s *Screen) WriteStderr(p []byte) (int, error) {
+	return s.write(p, &s.stderrPartial, true)
+}
+
+// write interprets the output of one stream. partial holds what was left
+// over from the last write of that stream
+func (s *Screen) write(p []byte, partial *[]byte, stderr bool) (int, error) {
+	data := append(*partial, p...)
+	*partial = nil
+	s.stderr = stderr
+
+	for i := 0; i < len(data); {
+		if data[i] == escByte {
+			n, complete := s.escape(data[i:])
+			if !complete {
+				*partial = append([]byte{}, data[i:]...)
+				break
+			}
+			i += n
+			continue
+		}
+
+		if !utf8.FullRune(data[i:]) {
+			*partial = append([]byte{}, data[i:]...)
+			break
+		}
+		r, size := utf8.DecodeRune(data[i:])
+		i += size
+
+		switch r {
+		case '\n':
+			s.flushPending()
+			s.moveTo(s.row+1, 0)
+		case '\r':
+			s.col = 0
+		case '\b':
+			if s.col > 0 {
+				s.col--
+			}
+		case belByte:
+		default:
+			s.put(r)
+		}
+	}
+	return len(p), nil
+}
+
+// String returns the text on the screen. It ends with a newline when the
+// cursor is at the start of an empty last line
+func (s *Screen) String() string {
+	var sb strings.Builder
+	for i, line := range s.lines {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		for _, cell := range line.cells {
+			sb.WriteString(cell.prefix)
+			sb.WriteRune(cell.char)
+		}
+		sb.WriteString(line.tail)
+	}
+	sb.WriteString(s.pending)
+	return sb.String()
+}
+
+// StderrLines returns the lines of String that hold characters written to
+// stderr
+func (s *Screen) StderrLines() []int {
+	lines := []int{}
+	for i, line := range s.lines {
+		for _, cell := range line.cells {
+			if cell.stderr {
+				lines = append(lines, i)
+				break
+			}
+		}
+	}
+	return lines
+}
+
+// put writes r at the cursor and moves the cursor right
+func (s *Screen) put(r rune) {
+	line := &s.lines[s.row]
+	for len(line.cells) <= s.col {
+		line.cells = append(line.cells, screenCell{char: ' '})
+	}
+	line.cells[s.col] = screenCell{prefix: s.pending, char: r, stderr: s.stderr}
+	s.pending = ""
+	s.col++
+}
+
+// moveTo moves the cursor, adding lines when it moves below the last one
+func (s *Screen) moveTo(row int, col int) {
+	if row < 0 {
+		row = 0
+	}
+	if col < 0 {
+		col = 0
+	}
+	for len(s.lines) <= row {
+		s.lines = append(s.lines, screenLine{})
+	}
+	s.row = row
+	s.col = col
+}
+
+// flushPending attaches escape sequences that weren't followed by a
+// character to the current line
+func (s *Screen) flushPending() {
+	s.lines[s.row].tail += s.pending
+	s.pending = ""
+}
+
+// escape handles the escape sequence at the start of data. Returns its
+// length, or false when data ends before the sequence does
+func (s *Screen) escape(data []byte) (int, bool) {
+	if len(data) < 2 {
+		return 0, false
+	}
+
+	switch data[1] {
+	case '[':
+		// CSI: parameter and intermediate bytes, then a final byte
+		for i := 2; i < len(data); i++ {
+			if data[i] >= 0x40 && data[i] <= 0x7e {
+				s.csi(string(data[2:i]), data[i], string(data[:i+1]))
+				return i + 1, true
+			}
+		}
+		return 0, false
+	case ']':
+		// OSC, e.g. window titles, ends with BEL or ESC \
+		for i := 2; i < len(data); i++ {
+			if data[i] == belByte {
+				return i + 1, true
+			}
+			if data[i] == escByte {
+				if i+1 >= len(data) {
+					return 0, false
+				}
+				if data[i+1] == '\\' {
+					return i + 2, true
+				}
+			}
+		}
+		return 0, false
+	default:
+		return 2, true
+	}
+}
+
+// csi applies a control sequence with the given parameters and final byte.
+// Unknown sequences are dropped
+func (s *Screen) csi(params string, final byte, sequence string) {
+	switch final {
+	case 'm':
+		s.pending += sequence
+	case 'A':
+		s.moveTo(s.row-csiParam(params, 0, 1), s.col)
+	case 'B':
+		s.moveTo(s.row+csiParam(params, 0, 1), s.col)
+	case 'C':
+		s.moveTo(s.row, s.col+csiParam(params, 0, 1))
+	case 'D':
+		s.moveTo(s.row, s.col-csiParam(params, 0, 1))
+	case 'E':
+		s.moveTo(s.row+csiParam(params, 0, 1), 0)
+	case 'F':
+		s.moveTo(s.row-csiParam(params, 0, 1), 0)
+	case 'G':
+		s.moveTo(s.row, csiParam(params, 0, 1)-1)
+	case 'H', 'f':
+		// without a height, rows are counted from the first line of output
+		s.moveTo(csiParam(params, 0, 1)-1, csiParam(params, 1, 1)-1)
+	case 'K':
+		s.eraseLine(csiParam(params, 0, 0))
+	case 'J':
+		s.eraseDisplay(csiParam(params, 0, 0))
+	}
+}
+
+// eraseLine erases from the cursor to the end of the line (0), from the
+// start of the line to the cursor (1) or the whole line (2)
+func (s *Screen) eraseLine(mode int) {
+	line := &s.lines[s.row]
+	switch mode {
+	case 0:
+		if s.col < len(line.cells) {
+			line.cells = line.cells[:s.col]
+		}
+		line.tail = ""
+	case 1:
+		for i := 0; i <= s.col && i < len(line.cells); i++ {
+			line.cells[i] = screenCell{char: ' '}
+		}
+	case 2:
+		line.cells = nil
+		line.tail = ""
+	}
+}
+
+// eraseDisplay erases from the cursor to the end of the screen (0), from
+// the start of the screen to the cursor (1) or everything (2 and 3)
+func (s *Screen) eraseDisplay(mode int) {
+	switch mode {
+	case 0:
+		s.eraseLine(0)
+		s.lines = s.lines[:s.row+1]
+	case 1:
+		for i := 0; i < s.row; i++ {
+			s.lines[i] = screenLine{}
+		}
+		s.eraseLine(1)
+	case 2, 3:
+		// the cursor stays where it is. clear moves it to the top left
+		// corner with ESC[H first
+		s.lines = make([]screenLine, s.row+1)
+	}
+}
+
+// csiParam returns the parameter at idx of a control sequence, or def when
+// it's missing or 0
+func csiParam(params string, idx int, def int) int {
+	parts := strings.Split(strings.TrimLeft(params, "?"), ";")
+	if idx >= len(parts) {
+		return def
+	}
+	n, err := strconv.Atoi(parts[idx])
+	if err != nil || n == 0 {
+		return def
+	}
+	return n
+}
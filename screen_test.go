@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScreen(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"plain", []string{"a\nb\n"}, "a\nb\n"},
+		{"no trailing newline", []string{"a\nb"}, "a\nb"},
+		{"carriage return", []string{"10%\r50%\r100%\n"}, "100%\n"},
+		{"crlf", []string{"a\r\nb\r\n"}, "a\nb\n"},
+		{"shorter overwrite", []string{"abc\rx\n"}, "xbc\n"},
+		{"backspace", []string{"ab\bc\n"}, "ac\n"},
+		{"erase line", []string{"progress\r\x1b[Kdone\n"}, "done\n"},
+		{"erase whole line", []string{"abc\x1b[2Kx\n"}, "   x\n"},
+		{"cursor up", []string{"a\nb\n\x1b[2Ac\n"}, "c\nb\n"},
+		{"cursor column", []string{"abcd\x1b[2Gx\n"}, "axcd\n"},
+		{"cursor position", []string{"abc\ndef\n\x1b[1;2Hx\x1b[2;3fy"}, "axc\ndey\n"},
+		{"cursor position defaults to top left", []string{"abc\n\x1b[Hx"}, "xbc\n"},
+		{"cursor position below output", []string{"a\x1b[3;2Hx"}, "a\n\n x"},
+		{"clear screen keeps cursor", []string{"a\nb\n\x1b[2Jc"}, "\n\nc"},
+		{"clear", []string{"a\nb\n\x1b[H\x1b[2J\x1b[3Jc"}, "c"},
+		{"colors are kept", []string{"\x1b[31mred\x1b[0m\n"}, "\x1b[31mred\x1b[0m\n"},
+		{"sequence split across writes", []string{"a\x1b[", "31mb\n"}, "a\x1b[31mb\n"},
+		{"utf8 split across writes", []string{"\xc3", "\xa4\n"}, "ä\n"},
+		{"window title is dropped", []string{"\x1b]0;title\x07a\n"}, "a\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			screen := NewScreen()
+			for _, w := range tt.writes {
+				screen.Write([]byte(w))
+			}
+			if got := screen.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScreenStderrLines(t *testing.T) {
+	screen := NewScreen()
+	screen.Write([]byte("out\n"))
+	screen.WriteStderr([]byte("err\n"))
+	screen.Write([]byte("out\n"))
+	screen.WriteStderr([]byte("e"))
+	screen.Write([]byte("o\n"))
+	if got, want := screen.StderrLines(), []int{1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("StderrLines() = %v, want %v", got, want)
+	}
+}
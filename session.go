@@ -0,0 +1,436 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mrWinston/mdrun.nvim/pkg/runner"
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+)
+
+var sessions = map[string]*Session{}
+var sessionsMutex = &sync.RWMutex{}
+
+var sessionCloseTimeout = 3 * time.Second
+
+// sessionInterruptGrace is how long an interrupted interpreter has to exit
+// before it's considered to have survived the interrupt
+var sessionInterruptGrace = 200 * time.Millisecond
+
+// Session is a long-lived interpreter. All codeblocks of a buffer with the
+// same language and SESSION are evaluated in it, one after the other
+type Session struct {
+	ID        string
+	Name      string
+	Language  string
+	Document  Document
+	StartedAt time.Time
+	// LastRun is the id of the codeblock that was evaluated most recently
+	LastRun string
+
+	editor   runner.Editor
+	runner   runner.ReplRunner
+	envVars  map[string]string
+	workdir  string
+	streamer *Streamer
+	listener net.Listener
+	done     chan struct{}
+
+	mutex       sync.Mutex
+	busy        bool
+	capturing   bool
+	runCount    int
+	startMarker string
+	endMarker   string
+	pending     string
+	evalDone    chan error
+}
+
+// SessionID returns the id of the session the codeblock is evaluated in
+func SessionID(cb *Codeblock) string {
+	return fmt.Sprintf("session_%d_%s_%s", cb.Document.ID(), cb.Language, cb.Opts[CbOptSession])
+}
+
+// GetSession returns the running session with the given id
+func GetSession(id string) (se *Session, ok bool) {
+	sessionsMutex.RLock()
+	defer sessionsMutex.RUnlock()
+	se, ok = sessions[id]
+	return se, ok
+}
+
+func addSession(se *Session) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	sessions[se.ID] = se
+}
+
+// removeSession removes the session from the registry, unless it has been
+// replaced by a restarted session with the same id in the meantime
+func removeSession(se *Session) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	if sessions[se.ID] == se {
+		delete(sessions, se.ID)
+	}
+}
+
+// GetSessions returns all running sessions
+func GetSessions() []*Session {
+	sessionsMutex.RLock()
+	defer sessionsMutex.RUnlock()
+	return lo.Values(sessions)
+}
+
+// GetSessionsForDocument returns all running sessions that belong to the
+// document with the given id
+func GetSessionsForDocument(docID int) []*Session {
+	return lo.Filter(GetSessions(), func(se *Session, _ int) bool {
+		return se.Document.ID() == docID
+	})
+}
+
+// CloseSessionsForDocument stops all sessions of the document with the given
+// id. Sessions that can't be stopped are removed from the registry anyway
+func CloseSessionsForDocument(docID int) {
+	for _, se := range GetSessionsForDocument(docID) {
+		if err := se.Close(); err != nil {
+			log.Errorf("Error closing session %s: %v", se.ID, err)
+			removeSession(se)
+		}
+	}
+}
+
+// StartSession starts the interpreter for the session of the given codeblock
+// in workdir
+func StartSession(e runner.Editor, cb *Codeblock, replRunner runner.ReplRunner, envVars map[string]string, workdir string) (*Session, error) {
+	se := &Session{
+		ID:       SessionID(cb),
+		Name:     cb.Opts[CbOptSession],
+		Language: cb.Language,
+		Document: cb.Document,
+		editor:   e,
+		runner:   replRunner,
+		envVars:  envVars,
+		workdir:  workdir,
+	}
+
+	return se, se.start()
+}
+
+func (se *Session) start() error {
+	cmd, err := se.runner.CreateReplCommand(se.editor, se.envVars)
+	if err != nil {
+		return err
+	}
+	cmd.Dir = se.workdir
+
+	se.done = make(chan struct{})
+	se.streamer = &Streamer{
+		Command: cmd,
+		Session: se,
+	}
+
+	log.Infof("Starting session %s: %s", se.ID, strings.Join(cmd.Args, " "))
+	err = se.streamer.Run()
+	if err != nil {
+		return err
+	}
+	se.StartedAt = time.Now()
+	addSession(se)
+
+	if err := se.listen(); err != nil {
+		log.Warnf("Can't open socket for session %s: %v", se.ID, err)
+	}
+
+	return nil
+}
+
+// Pid returns the process id of the interpreter
+func (se *Session) Pid() int {
+	if se.streamer.Command.Process == nil {
+		return 0
+	}
+	return se.streamer.Command.Process.Pid
+}
+
+// Busy returns whether a codeblock is currently evaluated in the session
+func (se *Session) Busy() bool {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+	return se.busy
+}
+
+// Interrupt sends SIGINT to the interpreter, which stops the current
+// evaluation but keeps the interpreter and its state alive
+func (se *Session) Interrupt() error {
+	pid := se.Pid()
+	if pid == 0 {
+		return fmt.Errorf("Session %s has no process", se.ID)
+	}
+	if !se.Busy() {
+		return fmt.Errorf("Session %s isn't evaluating anything", se.ID)
+	}
+	log.Debugf("Interrupting session %s: %d", se.ID, pid)
+	err := syscall.Kill(-pid, syscall.SIGINT)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-se.done:
+		return fmt.Errorf("Session %s exited when it was interrupted", se.ID)
+	case <-time.After(sessionInterruptGrace):
+	}
+	return nil
+}
+
+// Close stops the interpreter and waits until it has exited
+func (se *Session) Close() error {
+	pid := se.Pid()
+	if pid == 0 {
+		return fmt.Errorf("Session %s has no process", se.ID)
+	}
+	log.Debugf("Closing session %s: %d", se.ID, pid)
+	err := syscall.Kill(-pid, syscall.SIGTERM)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-se.done:
+	case <-time.After(sessionCloseTimeout):
+		log.Warnf("Session %s didn't exit after SIGTERM, killing it", se.ID)
+		_ = syscall.Kill(-pid, syscall.SIGKILL)
+		<-se.done
+	}
+	return nil
+}
+
+// Restart closes the interpreter and starts a new one with the same name.
+// All state of the old interpreter is lost
+func (se *Session) Restart() (*Session, error) {
+	err := se.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	restarted := &Session{
+		ID:       se.ID,
+		Name:     se.Name,
+		Language: se.Language,
+		Document: se.Document,
+		editor:   se.editor,
+		runner:   se.runner,
+		envVars:  se.envVars,
+		workdir:  se.workdir,
+	}
+
+	return restarted, restarted.start()
+}
+
+// listen opens a unix socket in the configured socket dir. Everything written
+// to it is sent to the interpreter of the session
+func (se *Session) listen() error {
+	if codeRunnerConfigs.SocketDir == "" {
+		return nil
+	}
+	err := os.MkdirAll(codeRunnerConfigs.SocketDir, 0700)
+	if err != nil {
+		return err
+	}
+	socketPath := path.Join(codeRunnerConfigs.SocketDir, se.ID+".sock")
+	_ = os.Remove(socketPath)
+
+	se.listener, err = net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := se.listener.Accept()
+			if err != nil {
+				return
+			}
+			go se.forward(conn)
+		}
+	}()
+
+	return nil
+}
+
+func (se *Session) forward(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if sendErr := se.streamer.Send(string(buf[:n])); sendErr != nil {
+				log.Errorf("Couldn't forward socket input to session %s: %v", se.ID, sendErr)
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Eval sends the code of source to the interpreter. The output between the
+// start and end marker is written to target. The returned channel receives
+// the result once the evaluation has finished
+func (se *Session) Eval(source *Codeblock, target *Codeblock) (<-chan error, error) {
+	se.mutex.Lock()
+	if se.busy {
+		se.mutex.Unlock()
+		return nil, fmt.Errorf("Session %s is still evaluating another codeblock", se.ID)
+	}
+	se.busy = true
+	se.evalDone = make(chan error, 1)
+	done := se.evalDone
+	se.capturing = false
+	se.LastRun = source.GetID()
+	se.runCount++
+	se.startMarker = fmt.Sprintf("__mdrun_start_%s_%d__", source.GetID(), se.runCount)
+	se.endMarker = fmt.Sprintf("__mdrun_end_%s_%d__", source.GetID(), se.runCount)
+	input := se.runner.ReplInput(source.Text, se.startMarker, se.endMarker)
+	se.mutex.Unlock()
+
+	se.streamer.SetBlocks(source, target)
+	if err := AddStreamer(se.streamer); err != nil {
+		se.cancelEval()
+		return nil, err
+	}
+
+	if err := se.streamer.Send(input); err != nil {
+		removeStreamerWithID(source.GetID())
+		se.cancelEval()
+		return nil, fmt.Errorf("Couldn't send codeblock to session %s: %w", se.ID, err)
+	}
+	return done, nil
+}
+
+// cancelEval clears the blocks of an evaluation that couldn't be started, so
+// that the session accepts the next one
+func (se *Session) cancelEval() {
+	se.streamer.SetBlocks(nil, nil)
+	se.mutex.Lock()
+	se.busy = false
+	se.mutex.Unlock()
+}
+
+// handleOutput receives everything the interpreter prints and forwards the
+// lines between the markers of the current evaluation to its target
+func (se *Session) handleOutput(text string) {
+	se.mutex.Lock()
+	lines := strings.SplitAfter(se.pending+text, "\n")
+	se.pending = lines[len(lines)-1]
+	lines = lines[:len(lines)-1]
+
+	var sb strings.Builder
+	finished := false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case !se.busy || finished:
+			continue
+		case strings.HasSuffix(trimmed, se.startMarker):
+			// prompts can end up in front of the marker
+			se.capturing = true
+		case strings.HasSuffix(trimmed, se.endMarker):
+			// output without a newline at its end is followed by the marker
+			// on the same line
+			if se.capturing {
+				sb.WriteString(line[:strings.LastIndex(line, se.endMarker)])
+			}
+			se.capturing = false
+			finished = true
+		case se.capturing:
+			sb.WriteString(line)
+		}
+	}
+	se.mutex.Unlock()
+
+	if sb.Len() > 0 {
+		if err := se.streamer.AddTextToTarget(sb.String()); err != nil {
+			log.Errorf("Error updating text of target codeblock: %v", err)
+		}
+	}
+	if finished {
+		se.finishEval(nil)
+	}
+}
+
+// handleExit is called once the interpreter of the session has stopped
+func (se *Session) handleExit(exitErr error) {
+	log.Infof("Session %s exited: %v", se.ID, exitErr)
+	defer close(se.done)
+	removeSession(se)
+	if se.listener != nil {
+		se.listener.Close()
+	}
+
+	se.mutex.Lock()
+	busy := se.busy
+	se.mutex.Unlock()
+	if busy {
+		if exitErr == nil {
+			exitErr = fmt.Errorf("Session %s exited", se.ID)
+		}
+		se.finishEval(exitErr)
+	}
+}
+
+func (se *Session) finishEval(evalErr error) {
+	source, target := se.streamer.Blocks()
+	se.streamer.SetBlocks(nil, nil)
+	defer func() {
+		se.mutex.Lock()
+		se.busy = false
+		se.evalDone <- evalErr
+		se.mutex.Unlock()
+	}()
+	if source == nil {
+		return
+	}
+	removeStreamerWithID(source.GetID())
+	defer releaseAnchors(source, target)
+
+	target.Opts[CbOptLastRun] = time.Now().Format(time.RFC3339)
+	exitCode := 0
+	if evalErr != nil && se.streamer.Command.ProcessState != nil {
+		exitCode = se.streamer.Command.ProcessState.ExitCode()
+	}
+	target.Opts[CbOptExitCode] = fmt.Sprintf("%d", exitCode)
+
+	err := se.streamer.writeFinalTarget(source, target)
+	if err != nil {
+		log.Errorf("Error writing target: %v", err)
+		return
+	}
+
+	evalErr = checkRun(source, target, exitCode, evalErr)
+	outGlyph := checkmarkGlyph
+	outHighlight := highlightGroupOk
+	if evalErr != nil {
+		outGlyph = errorGlyph
+		outHighlight = highlightGroupError
+	}
+
+	err = target.SetStatus(outGlyph, outHighlight)
+	if err != nil {
+		log.Errorf("Couldn't set status on target codeblock %v", err)
+	}
+	err = source.SetStatus(outGlyph, outHighlight)
+	if err != nil {
+		log.Errorf("Couldn't set status on Source codeblock %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mrWinston/mdrun.nvim/pkg/runner"
+)
+
+// brokenPipe fails every write, like the stdin of an exited interpreter
+type brokenPipe struct{}
+
+func (brokenPipe) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestSessionEvalSendError(t *testing.T) {
+	se := &Session{
+		ID:       "session_test",
+		runner:   &runner.ShellRunner{DefaultShell: "sh"},
+		streamer: &Streamer{stdIn: brokenPipe{}},
+	}
+	for i := 0; i < 2; i++ {
+		source := &Codeblock{Language: "shell", Text: "true\n", Opts: map[string]string{CbOptID: "send_error"}}
+		target := &Codeblock{Language: "out", Opts: map[string]string{}}
+		if _, err := se.Eval(source, target); err == nil || !strings.Contains(err.Error(), "broken pipe") {
+			t.Fatalf("eval %d: expected the error of the write, got %v", i, err)
+		}
+		if se.busy {
+			t.Fatalf("eval %d: session is still busy", i)
+		}
+		if source, target := se.streamer.Blocks(); source != nil || target != nil {
+			t.Fatalf("eval %d: session still has blocks %v and %v", i, source, target)
+		}
+		if _, ok := GetStreamerWithID("send_error"); ok {
+			t.Fatalf("eval %d: streamer is still registered", i)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stopSignalLadder is the order in which signals get stronger when stopping a
+// codeblock
+var stopSignalLadder = []syscall.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL}
+
+var signalsByName = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// ParseSignal returns the signal with the given name, e.g. SIGTERM or TERM
+func ParseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := signalsByName[name]
+	if !ok {
+		return 0, fmt.Errorf("Unknown signal '%s'", name)
+	}
+	return sig, nil
+}
+
+// SignalName returns the name of the signal as used in the config, e.g. SIGTERM
+func SignalName(sig syscall.Signal) string {
+	for name, s := range signalsByName {
+		if s == sig {
+			return name
+		}
+	}
+	return fmt.Sprintf("SIG%d", int(sig))
+}
+
+// stopProcessGroup sends the given signals to the process group of pid one
+// after the other. After each signal it waits up to gracePeriod for exited to
+// be closed before sending the next one. sent is called for every signal
+// that was sent
+func stopProcessGroup(pid int, signals []syscall.Signal, gracePeriod time.Duration, exited <-chan struct{}, sent func(syscall.Signal)) error {
+	for i, sig := range signals {
+		log.Debugf("Sending %s to process group %d", SignalName(sig), pid)
+		err := syscall.Kill(-pid, sig)
+		if errors.Is(err, syscall.ESRCH) {
+			// already gone
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Couldn't send %s to %d: %w", SignalName(sig), pid, err)
+		}
+		sent(sig)
+
+		if i == len(signals)-1 {
+			return nil
+		}
+		select {
+		case <-exited:
+			return nil
+		case <-time.After(gracePeriod):
+			log.Warnf("Process group %d still running %s after %s", pid, gracePeriod, SignalName(sig))
+		}
+	}
+	return nil
+}
+
+// setStopOpts records in the options of an out block whether the codeblock
+// timed out and which signal stopped it. Both are removed when it wasn't
+// stopped
+func setStopOpts(opts map[string]string, timedOut bool, sig syscall.Signal) {
+	delete(opts, CbOptTimedOut)
+	delete(opts, CbOptSignal)
+	if timedOut {
+		opts[CbOptTimedOut] = "true"
+	}
+	if sig != 0 {
+		opts[CbOptSignal] = SignalName(sig)
+	}
+}
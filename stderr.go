@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// ErrSeparate writes stderr to its own out block instead of interleaving
+	// it with stdout
+	ErrSeparate = "separate"
+	// StreamStderr is the STREAM of the out block that receives stderr
+	StreamStderr = "stderr"
+)
+
+// SeparateStderr returns whether stderr of the codeblock is written to its
+// own out block
+func (cb *Codeblock) SeparateStderr() bool {
+	return cb.Opts[CbOptErr] == ErrSeparate
+}
+
+// IsStderrTarget returns whether the codeblock is the out block receiving
+// stderr of its source
+func (cb *Codeblock) IsStderrTarget() bool {
+	return cb.Opts[CbOptStream] == StreamStderr
+}
+
+// IsTargetOf returns whether the codeblock is an out block of source for the
+// given stream. Its SOURCE can be the ID or the NAME of source. The stream of
+// the stdout block is empty, as it also receives stderr unless that is
+// separated
+func (cb *Codeblock) IsTargetOf(source *Codeblock, stream string) bool {
+	return source.HasRef(cb.Opts[CbOptSource]) && cb.Opts[CbOptStream] == stream && !cb.IsExpectBlock()
+}
+
+// GetStderrTargetCodeblock finds the out block receiving stderr of this
+// codeblock. Returns nil when nothing is found
+func (cb *Codeblock) GetStderrTargetCodeblock() (*Codeblock, error) {
+	if cb.Opts[CbOptID] == "" && cb.Opts[CbOptName] == "" {
+		return nil, fmt.Errorf("Can't get stderr target of codeblock without id")
+	}
+	codeblocks, err := GetCodeblocks(cb.Document)
+	if err != nil {
+		return nil, err
+	}
+	return cb.FindTarget(codeblocks, StreamStderr), nil
+}
+
+// NewStderrTargetCodeblock creates the out block for stderr of source right
+// below its stdout target and returns it
+func NewStderrTargetCodeblock(source *Codeblock, target *Codeblock) (*Codeblock, error) {
+	errTarget := &Codeblock{
+		Language: target.Language,
+		Opts: map[string]string{
+			CbOptSource: source.GetID(),
+			CbOptStream: StreamStderr,
+		},
+		Fence:    Fence{Char: target.Fence.Char, Indent: target.Fence.Indent},
+		Document: source.Document,
+	}
+
+	lines, err := source.Document.Lines()
+	if err != nil {
+		return nil, err
+	}
+	writeLine := target.EndLine + 1
+	if writeLine >= len(lines) {
+		writeLine = len(lines)
+	}
+
+	newLines := append([][]byte{[]byte("")}, errTarget.GetMarkdownLines()...)
+	err = source.Document.SetLines(writeLine, writeLine, newLines)
+	if err != nil {
+		return nil, err
+	}
+	errTarget.StartLine = writeLine + 1
+	errTarget.EndLine = writeLine + len(newLines) - 1
+	return errTarget, nil
+}
+
+// stderrHighlights returns highlights covering the given lines of text,
+// which were written to stderr
+func stderrHighlights(text string, stderrLines []int) []Highlight {
+	lines := strings.Split(text, "\n")
+	highlights := []Highlight{}
+	for _, line := range stderrLines {
+		if line >= len(lines) || lines[line] == "" {
+			continue
+		}
+		highlights = append(highlights, Highlight{
+			Line:     line,
+			StartCol: 0,
+			EndCol:   len(lines[line]),
+			Style:    DefaultTextStyle,
+			Link:     highlightGroupError,
+		})
+	}
+	return highlights
+}
@@ -9,8 +9,7 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/neovim/go-client/nvim"
-	"github.com/samber/lo"
+	"github.com/creack/pty"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -45,32 +44,93 @@ func GetStreamerWithID(id string) (st *Streamer, ok bool) {
 	return st, ok
 }
 
-// Kill terminates this streamer by sending SIGINT to it
+// Kill stops this streamer with the configured stop signal, followed by
+// stronger signals while it's still running after the grace period. For
+// sessions only the current evaluation is interrupted
 func (s *Streamer) Kill() error {
 	if s.Command.Process == nil {
 		// command hasn't started yet
 		return fmt.Errorf("Can't kill a process that has not started yet")
 	}
-	log.Debugf("Sending signal to kill process: %d", s.Command.Process.Pid)
-	return syscall.Kill(-s.Command.Process.Pid, syscall.SIGINT)
+	if s.Session != nil {
+		return s.Session.Interrupt()
+	}
+	s.stop(false)
+	return nil
+}
+
+// stop starts sending the stop signals to the process group, unless that
+// already happens
+func (s *Streamer) stop(timedOut bool) {
+	s.stopMutex.Lock()
+	defer s.stopMutex.Unlock()
+	if s.stopping {
+		return
+	}
+	s.stopping = true
+	s.timedOut = timedOut
+
+	pid := s.Command.Process.Pid
+	go func() {
+		err := stopProcessGroup(pid, codeRunnerConfigs.StopSignals(), codeRunnerConfigs.GracePeriod(), s.exited, func(sig syscall.Signal) {
+			s.stopMutex.Lock()
+			defer s.stopMutex.Unlock()
+			s.stopSignal = sig
+		})
+		if err != nil {
+			log.Errorf("Error stopping process %d: %v", pid, err)
+		}
+	}()
+}
 
+// stopState returns whether the streamer was stopped because of its timeout
+// and the last signal sent to stop it
+func (s *Streamer) stopState() (timedOut bool, sig syscall.Signal) {
+	s.stopMutex.Lock()
+	defer s.stopMutex.Unlock()
+	return s.timedOut, s.stopSignal
 }
 
 // Streamer wraps the execution of an exec.Cmd and allows access to its
 // stdin/out/err while it is running
 type Streamer struct {
-	V       *nvim.Nvim
 	Source  *Codeblock
 	Target  *Codeblock
 	Command *exec.Cmd
-
+	// Session is set when the command is a long-lived interpreter. Source and
+	// Target then point to the codeblock currently evaluated in it
+	Session *Session
+	// Timeout stops the command when it runs longer, if set
+	Timeout time.Duration
+	// Pty is the size of the pseudo terminal to run the command in. The
+	// command gets plain pipes when it's nil
+	Pty *pty.Winsize
+	// ErrTarget receives stderr when it's separated from stdout, see
+	// ERR=separate. Stderr is interleaved with stdout when it's nil
+	ErrTarget *Codeblock
+	// CodeDir is the dir the code was written to. It's removed once the
+	// command has exited
+	CodeDir string
+
+	blocksMutex          sync.RWMutex
 	stdOutChan           chan string
 	stdErrChan           chan string
 	updateStatusStopChan chan int
 	ticker               *time.Ticker
 	writeDoneChan        chan int
 	writeStopChan        chan int
+	done                 chan error
 	stdIn                io.Writer
+	exited               chan struct{}
+	ptmx                 *os.File
+	output               *streamOutput
+	errOutput            *streamOutput
+	timeoutTimer         *time.Timer
+
+	stopMutex  sync.Mutex
+	stopping   bool
+	timedOut   bool
+	stopSignal syscall.Signal
 }
 
 // Send writes the given string to the stdin of the streamer
@@ -86,25 +146,62 @@ func (s *Streamer) Run() error {
 	s.updateStatusStopChan = make(chan int)
 	s.writeDoneChan = make(chan int)
 	s.writeStopChan = make(chan int)
+	s.done = make(chan error, 1)
+	s.exited = make(chan struct{})
+	s.output = newStreamOutput()
+	if s.ErrTarget != nil {
+		s.errOutput = newStreamOutput()
+	}
 
 	s.ticker = time.NewTicker(tickerUpdateInterval)
 	s.Command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-	stdout, err := s.Command.StdoutPipe()
+	var err error
+	if s.Pty != nil {
+		err = s.startInPty()
+	} else {
+		err = s.startWithPipes()
+	}
 	if err != nil {
 		return err
 	}
 
-	stderr, err := s.Command.StderrPipe()
+	if s.Timeout > 0 {
+		s.timeoutTimer = time.AfterFunc(s.Timeout, func() {
+			log.Infof("Codeblock %s timed out after %s", s.Source.GetID(), s.Timeout)
+			s.stop(true)
+		})
+	}
+	go s.waitForCompletion()
+
+	return nil
+}
+
+// startWithPipes starts the command with separate pipes for stdin, stdout
+// and stderr
+func (s *Streamer) startWithPipes() error {
+	stdout, err := s.Command.StdoutPipe()
 	if err != nil {
 		return err
 	}
+
+	if s.Session != nil {
+		// sessions need both streams in order, otherwise the end marker can
+		// overtake the error output of a codeblock
+		s.Command.Stderr = s.Command.Stdout
+		close(s.stdErrChan)
+	} else {
+		stderr, err := s.Command.StderrPipe()
+		if err != nil {
+			return err
+		}
+		go readerToChannel(stderr, s.stdErrChan)
+	}
   s.stdIn, err = s.Command.StdinPipe()
 	if err != nil {
 		return err
 	}
 	go readerToChannel(stdout, s.stdOutChan)
-	go readerToChannel(stderr, s.stdErrChan)
 	go s.UpdateLoop()
 	go s.updateStatusLoop()
 
@@ -112,10 +209,28 @@ func (s *Streamer) Run() error {
 	if err != nil {
 		log.Errorf("Got error starting: %v", err)
 		s.updateStatusStopChan <- 0
+		s.done <- err
 		return err
 	}
-	go s.waitForCompletion()
+	return nil
+}
 
+// startInPty starts the command in a pseudo terminal. Its stdout and stderr
+// are merged, so all output goes through the stdout channel
+func (s *Streamer) startInPty() error {
+	ptmx, err := startInPty(s.Command, s.Pty)
+	if err != nil {
+		log.Errorf("Got error starting: %v", err)
+		s.ticker.Stop()
+		s.done <- err
+		return err
+	}
+	s.ptmx = ptmx
+	s.stdIn = ptmx
+	close(s.stdErrChan)
+	go readerToChannel(ptmx, s.stdOutChan)
+	go s.UpdateLoop()
+	go s.updateStatusLoop()
 	return nil
 }
 
@@ -126,23 +241,34 @@ func (s *Streamer) updateStatusLoop() {
 		case <-s.updateStatusStopChan:
 			return
 		case <-s.ticker.C:
-			curGlyph := clockAnimationGlyphs[currentRun%len(clockAnimationGlyphs)]
-			err := s.Source.SetStatus(s.V, curGlyph, highlightGroupInfo)
-			if err != nil {
-				log.Errorf("couldn't set extmark: %v", err)
-			}
-
-			err = s.Target.SetStatus(s.V, curGlyph, highlightGroupInfo)
-			if err != nil {
-				log.Errorf("couldn't set extmark: %v", err)
-			}
-
+			s.setRunningStatus(clockAnimationGlyphs[currentRun%len(clockAnimationGlyphs)])
 			currentRun++
 		}
 	}
 
 }
 
+// setRunningStatus shows the glyph on the source and target codeblock. It
+// holds blocksMutex, so SetBlocks waits until the glyph is set and the blocks
+// can be finished afterwards
+func (s *Streamer) setRunningStatus(glyph string) {
+	s.blocksMutex.RLock()
+	defer s.blocksMutex.RUnlock()
+	if s.Source == nil || s.Target == nil {
+		// idle session
+		return
+	}
+	err := s.Source.SetStatus(glyph, highlightGroupInfo)
+	if err != nil {
+		log.Errorf("couldn't set extmark: %v", err)
+	}
+
+	err = s.Target.SetStatus(glyph, highlightGroupInfo)
+	if err != nil {
+		log.Errorf("couldn't set extmark: %v", err)
+	}
+}
+
 func (s *Streamer) waitForCompletion() {
 	log.Infof("waiting for readers to close")
 	<-s.writeDoneChan
@@ -152,45 +278,85 @@ func (s *Streamer) waitForCompletion() {
 	s.writeStopChan <- 0
 
 	err := s.Command.Wait()
+	if s.timeoutTimer != nil {
+		s.timeoutTimer.Stop()
+	}
+	close(s.exited)
+	if s.ptmx != nil {
+		s.ptmx.Close()
+	}
+	if s.CodeDir != "" {
+		if err := os.RemoveAll(s.CodeDir); err != nil {
+			log.Errorf("Couldn't remove code dir %s: %v", s.CodeDir, err)
+		}
+	}
 
-	var outGlyph string
-	var outHighlight string
-	if err != nil {
-		outGlyph = errorGlyph
-		outHighlight = highlightGroupError
-	} else {
-		outGlyph = checkmarkGlyph
-		outHighlight = highlightGroupOk
+	if s.Session != nil {
+		s.Session.handleExit(err)
+		return
 	}
+	runErr := err
+	defer func() {
+		s.done <- runErr
+	}()
+	defer removeStreamerWithID(s.Source.GetID())
+	defer releaseAnchors(s.Source, s.Target, s.ErrTarget)
 
 	log.Infof("Completed wait: %s", err)
 
-
-  s.Source.GetID()
-  target, err := FindCodeblockByOpt(CbOptSource, s.Source.GetID(), s.Source.Buffer)
-  if err != nil {
-    log.Errorf("Coulnd't find target codeblock: %v", err)
-    return
-  }
-  s.Target = target
-
 	s.Target.Opts[CbOptLastRun] = time.Now().Format(time.RFC3339)
-	s.Target.Opts["EXIT_CODE"] = fmt.Sprintf("%d", s.Command.ProcessState.ExitCode())
+	s.Target.Opts[CbOptExitCode] = fmt.Sprintf("%d", s.Command.ProcessState.ExitCode())
+	timedOut, sig := s.stopState()
+	setStopOpts(s.Target.Opts, timedOut, sig)
 
-	err = s.Target.Write(s.V)
+	err = s.writeFinalTarget(s.Source, s.Target)
 	if err != nil {
 		log.Errorf("Error writing target: %v", err)
+		if err := s.Source.SetStatus(errorGlyph, highlightGroupError); err != nil {
+			log.Errorf("Couldn't set status on Source codeblock %v", err)
+		}
+		return
+	}
+	s.blocksMutex.RLock()
+	output := s.output.screen.String()
+	s.blocksMutex.RUnlock()
+	if s.ErrTarget != nil {
+		s.writeFinalErrTarget()
+		output += "\n" + s.errOutput.screen.String()
 	}
+	PublishDiagnostics(s.Source, s.CodeDir, s.Command.Dir, output)
 
-	err = s.Target.SetStatus(s.V, outGlyph, outHighlight)
+	runErr = checkRun(s.Source, s.Target, s.Command.ProcessState.ExitCode(), runErr)
+	outGlyph := checkmarkGlyph
+	outHighlight := highlightGroupOk
+	if runErr != nil {
+		outGlyph = errorGlyph
+		outHighlight = highlightGroupError
+	}
+
+	err = s.Target.SetStatus(outGlyph, outHighlight)
 	if err != nil {
 		log.Errorf("Couldn't set status on target codeblock %v", err)
 	}
-	err = s.Source.SetStatus(s.V, outGlyph, outHighlight)
+	if s.ErrTarget != nil {
+		err = s.ErrTarget.SetStatus(outGlyph, outHighlight)
+		if err != nil {
+			log.Errorf("Couldn't set status on stderr target codeblock %v", err)
+		}
+	}
+	err = s.Source.SetStatus(outGlyph, outHighlight)
 	if err != nil {
 		log.Errorf("Couldn't set status on Source codeblock %v", err)
 	}
-	removeStreamerWithID(s.Target.GetID())
+}
+
+// writeFinalErrTarget writes the stderr target once the codeblock has
+// finished
+func (s *Streamer) writeFinalErrTarget() {
+	err := s.errOutput.writeFinal(s.Source, s.ErrTarget)
+	if err != nil {
+		log.Errorf("Error writing stderr target: %v", err)
+	}
 }
 
 func (s *Streamer) UpdateLoop() {
@@ -200,10 +366,21 @@ func (s *Streamer) UpdateLoop() {
 			os.Exit(1)
 		}
 	}()
+	var flushChan <-chan time.Time
+	if interval := codeRunnerConfigs.OutputFlushInterval(); interval > 0 {
+		flushTicker := time.NewTicker(interval)
+		defer flushTicker.Stop()
+		flushChan = flushTicker.C
+	}
+
 	for {
 		select {
 		case <-s.writeStopChan:
 			return
+		case <-flushChan:
+			if err := s.flush(); err != nil {
+				log.Errorf("Error updating text of target codeblock: %v", err)
+			}
 		case t, ok := <-s.stdOutChan:
 			if !ok {
 				log.Infof("")
@@ -211,6 +388,10 @@ func (s *Streamer) UpdateLoop() {
 				s.stdOutChan = nil
 				break
 			}
+			if s.Session != nil {
+				s.Session.handleOutput(t)
+				break
+			}
 			if err := s.AddTextToTarget(t); err != nil {
 				log.Errorf("Error updating text of target codeblock: %v", err)
 			}
@@ -221,7 +402,7 @@ func (s *Streamer) UpdateLoop() {
 				s.stdErrChan = nil
 				break
 			}
-			if err := s.AddTextToTarget(t); err != nil {
+			if err := s.AddStderrToTarget(t); err != nil {
 				log.Errorf("Error updating text of target codeblock: %v", err)
 			}
 		}
@@ -229,14 +410,238 @@ func (s *Streamer) UpdateLoop() {
 
 }
 
-func (s *Streamer) AddTextToTarget(t string) error {
+// Blocks returns the source and target codeblock of this streamer
+func (s *Streamer) Blocks() (source *Codeblock, target *Codeblock) {
+	s.blocksMutex.RLock()
+	defer s.blocksMutex.RUnlock()
+	return s.Source, s.Target
+}
+
+// SetBlocks replaces the source and target codeblock of this streamer
+func (s *Streamer) SetBlocks(source *Codeblock, target *Codeblock) {
+	s.blocksMutex.Lock()
+	defer s.blocksMutex.Unlock()
+	s.Source = source
+	s.Target = target
+	if target != nil {
+		// the output of the last evaluation is still needed to write its
+		// target when it has finished
+		s.output = newStreamOutput()
+	}
+}
+
+// renderedOutput is the output as it's written to the target
+type renderedOutput struct {
+	Text string
+	// Full is the output before it was truncated
+	Full       string
+	Highlights []Highlight
+	// Render is set when the highlights should be applied
+	Render bool
+	// Truncated is set when Text doesn't hold the full output
+	Truncated bool
+}
+
+// streamOutput is the output of the command as it's written to one target
+type streamOutput struct {
+	// screen renders the output before it's written to the target
+	screen *Screen
+	// dirty is set when the screen changed since the last write
+	dirty bool
+	// writtenLines and writtenHeader are the text lines and start line of
+	// the target as they were written last
+	writtenLines  []string
+	writtenHeader string
+}
+
+func newStreamOutput() *streamOutput {
+	return &streamOutput{screen: NewScreen()}
+}
+
+// render returns the text on the screen. The ANSI option of source decides
+// whether color sequences are kept, removed or turned into highlights. Lines
+// written to stderr are highlighted as errors. The text is normalized and
+// truncated to the output limits of source
+func (o *streamOutput) render(source *Codeblock) renderedOutput {
+	out := renderedOutput{Text: o.screen.String()}
+	mode := source.Opts[CbOptAnsi]
+	if mode == AnsiRender || mode == AnsiStrip {
+		var highlights []Highlight
+		out.Text, highlights = ParseANSI(out.Text)
+		if mode == AnsiRender {
+			out.Highlights = highlights
+		}
+	}
+	if normalizer, err := codeRunnerConfigs.Normalizer(source); err != nil {
+		log.Errorf("Not normalizing output: %v", err)
+	} else if !normalizer.Empty() {
+		out.Text = normalizer.Apply(out.Text)
+		out.Highlights = clampHighlights(out.Highlights, out.Text)
+	}
+	out.Highlights = append(out.Highlights, stderrHighlights(out.Text, o.screen.StderrLines())...)
+	out.Render = mode == AnsiRender || len(out.Highlights) > 0
+	out.Full = out.Text
+
+	limits, err := codeRunnerConfigs.OutputLimits(source)
+	if err != nil {
+		log.Errorf("Not limiting output: %v", err)
+		return out
+	}
+	var mapping []int
+	out.Text, mapping, out.Truncated = limits.Truncate(out.Text)
+	if out.Truncated {
+		out.Highlights = remapHighlights(out.Highlights, mapping)
+	}
+	return out
+}
+
+// write replaces the whole target with what's on the screen
+func (o *streamOutput) write(source *Codeblock, target *Codeblock) error {
+	out := o.render(source)
+
+	target.Text = out.Text
+	if err := target.Write(); err != nil {
+		return err
+	}
+	o.dirty = false
+	o.writtenLines = codeblockTextLines(out.Text)
+	o.writtenHeader = string(target.GetMarkdownLines()[0])
+
+	if !out.Render {
+		return nil
+	}
+	return target.SetHighlights(out.Highlights)
+}
+
+// writeFinal writes the target once the codeblock has finished. When the
+// output didn't fit the limits, the full output is written to a log file
+// whose path in the log dir is recorded in the LOG option of target
+func (o *streamOutput) writeFinal(source *Codeblock, target *Codeblock) error {
+	delete(target.Opts, CbOptLog)
+	if out := o.render(source); out.Truncated {
+		logPath, err := WriteOutputLog(source, target.Opts[CbOptStream], out.Full)
+		if err != nil {
+			log.Errorf("Couldn't write full output of %s: %v", source.Ref(), err)
+		} else {
+			target.Opts[CbOptLog] = logPath
+		}
+	}
+	return o.write(source, target)
+}
+
+// appendTo updates the target with what's on the screen. Only the lines
+// that changed since the last write are replaced, which usually are the last
+// few. The whole target is written when it can't be found where it was
+// written last
+func (o *streamOutput) appendTo(source *Codeblock, target *Codeblock) error {
+	if _, err := target.Locate(); err != nil {
+		return err
+	}
+	md, err := target.Document.Markdown()
+	if err != nil {
+		return err
+	}
+	if o.writtenLines == nil || target.StartLine >= md.LineCount() || md.Line(target.StartLine) != o.writtenHeader {
+		return o.write(source, target)
+	}
+
+	out := o.render(source)
+	newLines := codeblockTextLines(out.Text)
+	common := 0
+	for common < len(newLines) && common < len(o.writtenLines) && newLines[common] == o.writtenLines[common] {
+		common++
+	}
+
+	firstLine := target.StartLine + 1
+	changed := make([][]byte, 0, len(newLines)-common)
+	for _, line := range newLines[common:] {
+		changed = append(changed, []byte(line))
+	}
+	err = target.Document.SetLines(firstLine+common, firstLine+len(o.writtenLines), changed)
+	if err != nil {
+		return err
+	}
+	target.Text = out.Text
+	target.EndLine = firstLine + len(newLines)
+	o.dirty = false
+	o.writtenLines = newLines
+
+	if !out.Render {
+		return nil
+	}
+	changedHighlights := []Highlight{}
+	for _, h := range out.Highlights {
+		if h.Line >= common {
+			h.Line += firstLine
+			changedHighlights = append(changedHighlights, h)
+		}
+	}
+	return target.Document.SetHighlights(firstLine+common, target.EndLine, changedHighlights)
+}
+
+// flush writes output that was added since the last write to the target
+func (o *streamOutput) flush(source *Codeblock, target *Codeblock) error {
+	if !o.dirty || source == nil || target == nil {
+		return nil
+	}
 	n := time.Now()
-	s.Target.Text = s.Target.Text + t
-	err := s.Target.Write(s.V)
+	err := o.appendTo(source, target)
 	log.Debugf("Updating text took: %s", time.Since(n).String())
 	return err
 }
 
+// writeFinalTarget writes the stdout target once the codeblock has finished
+func (s *Streamer) writeFinalTarget(source *Codeblock, target *Codeblock) error {
+	s.blocksMutex.RLock()
+	defer s.blocksMutex.RUnlock()
+	return s.output.writeFinal(source, target)
+}
+
+// AddTextToTarget writes output to the screen of the streamer. The target
+// is updated with the next flush
+func (s *Streamer) AddTextToTarget(t string) error {
+	s.blocksMutex.RLock()
+	s.output.screen.Write([]byte(t))
+	s.output.dirty = true
+	s.blocksMutex.RUnlock()
+	if codeRunnerConfigs.OutputFlushInterval() <= 0 {
+		return s.flush()
+	}
+	return nil
+}
+
+// AddStderrToTarget writes stderr output to the screen of the stderr target
+// if there is one, otherwise it's interleaved with stdout and highlighted
+func (s *Streamer) AddStderrToTarget(t string) error {
+	s.blocksMutex.RLock()
+	if s.errOutput != nil {
+		s.errOutput.screen.Write([]byte(t))
+		s.errOutput.dirty = true
+	} else {
+		s.output.screen.WriteStderr([]byte(t))
+		s.output.dirty = true
+	}
+	s.blocksMutex.RUnlock()
+	if codeRunnerConfigs.OutputFlushInterval() <= 0 {
+		return s.flush()
+	}
+	return nil
+}
+
+// flush writes output that was added since the last write to the targets.
+// It holds blocksMutex, so SetBlocks can't swap the output while it's written
+func (s *Streamer) flush() error {
+	s.blocksMutex.RLock()
+	defer s.blocksMutex.RUnlock()
+	if err := s.output.flush(s.Source, s.Target); err != nil {
+		return err
+	}
+	if s.errOutput == nil {
+		return nil
+	}
+	return s.errOutput.flush(s.Source, s.ErrTarget)
+}
+
 func readerToChannel(reader io.Reader, outChannel chan<- string) {
 	buf := make([]byte, 1024)
 	// okay, so reading by byte is tricky, doing it linewise instead
@@ -248,11 +653,16 @@ func readerToChannel(reader io.Reader, outChannel chan<- string) {
 			return
 		}
 
-		buf = lo.Replace(buf, 0xd, 0xa, -1)
 		outChannel <- string(buf[0:n])
 	}
 }
 
+// Done receives the result of the command once it has finished and its
+// output is written. Not used for sessions, see Session.Eval
+func (s *Streamer) Done() <-chan error {
+	return s.done
+}
+
 func (s *Streamer) Finished() bool {
 	return s.Command.ProcessState != nil
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mrWinston/mdrun.nvim/pkg/runner"
+	"github.com/samber/lo"
+)
+
+// ResolveWorkdir returns the absolute directory the codeblock runs in. Env
+// vars in its CWD option are expanded and a relative CWD is resolved against
+// the directory of the file of its document, which is also the default.
+// Documents without a file use the current directory. CWD=docker:<container>
+// is returned as it is. Codeblocks with a WORKSPACE and without CWD run in
+// their workspace
+func ResolveWorkdir(cb *Codeblock, envVars map[string]string) (string, error) {
+	workdir := cb.Opts[CbOptWorkdir]
+	if _, ok := cb.Opts[CbOptWorkspace]; ok && workdir == "" {
+		workdir = envVars[WorkspaceEnvVar]
+	}
+	if strings.HasPrefix(workdir, CbOptWorkdirDockerPrefix+":") {
+		return workdir, nil
+	}
+
+	workdir = os.Expand(workdir, func(name string) string {
+		if val, ok := envVars[name]; ok {
+			return val
+		}
+		return os.Getenv(name)
+	})
+	if workdir == "~" || strings.HasPrefix(workdir, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		workdir = home + strings.TrimPrefix(workdir, "~")
+	}
+
+	if !filepath.IsAbs(workdir) {
+		base := ""
+		if docPath := cb.Document.Path(); docPath != "" {
+			base = filepath.Dir(docPath)
+		} else {
+			cwd, err := os.Getwd()
+			if err != nil {
+				return "", err
+			}
+			base = cwd
+		}
+		workdir = filepath.Join(base, workdir)
+	}
+
+	info, err := os.Stat(workdir)
+	if err != nil || !info.IsDir() {
+		return "", fmt.Errorf("Workdir %s of %s doesn't exist", workdir, cb.Ref())
+	}
+	return workdir, nil
+}
+
+// RunnerOpts returns the options of the codeblock as passed to its runner,
+// with the CWD option resolved by ResolveWorkdir. The code dir is left to
+// the runner
+func RunnerOpts(cb *Codeblock, envVars map[string]string) (map[string]string, error) {
+	workdir, err := ResolveWorkdir(cb, envVars)
+	if err != nil {
+		return nil, err
+	}
+	opts := lo.Assign(cb.Opts)
+	opts[CbOptWorkdir] = workdir
+	delete(opts, runner.RUNNER_OPT_CODE_DIR)
+	return opts, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// WorkspaceShared is the workspace shared by all codeblocks of a
+	// document that don't name their own one
+	WorkspaceShared = "shared"
+	// WorkspaceEnvVar holds the workspace dir of a codeblock
+	WorkspaceEnvVar = "MDRUN_WORKSPACE"
+)
+
+var workspaceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+type workspaceKey struct {
+	docID int
+	name  string
+}
+
+var workspaces = map[workspaceKey]string{}
+var workspacesMutex = sync.Mutex{}
+
+// Workspace returns the workspace dir of the codeblock, which is shared with
+// all codeblocks of its document that have the same WORKSPACE. It's created
+// on first use. Returns an empty string when WORKSPACE isn't set
+func Workspace(cb *Codeblock) (string, error) {
+	name, ok := cb.Opts[CbOptWorkspace]
+	if !ok {
+		return "", nil
+	}
+	if !workspaceNamePattern.MatchString(name) {
+		return "", fmt.Errorf("Invalid %s '%s', expected %s or a name of letters, digits, '_', '.' and '-'", CbOptWorkspace, name, WorkspaceShared)
+	}
+
+	workspacesMutex.Lock()
+	defer workspacesMutex.Unlock()
+	key := workspaceKey{docID: cb.Document.ID(), name: name}
+	if dir, ok := workspaces[key]; ok {
+		return dir, nil
+	}
+
+	root := codeRunnerConfigs.WorkspaceDir
+	if root == "" {
+		root = path.Join(os.TempDir(), "mdrun-workspaces")
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return "", fmt.Errorf("Couldn't create workspace dir: %w", err)
+	}
+	dir, err := os.MkdirTemp(root, fmt.Sprintf("%d-%s-", key.docID, name))
+	if err != nil {
+		return "", fmt.Errorf("Couldn't create workspace %s: %w", name, err)
+	}
+	log.Infof("Created workspace %s of document %d in %s", name, key.docID, dir)
+	workspaces[key] = dir
+	return dir, nil
+}
+
+// WorkspaceEnvVars returns a copy of envVars with WorkspaceEnvVar set to the
+// workspace of the codeblock, if it has one
+func WorkspaceEnvVars(cb *Codeblock, envVars map[string]string) (map[string]string, error) {
+	dir, err := Workspace(cb)
+	if err != nil || dir == "" {
+		return envVars, err
+	}
+	withWorkspace := lo.Assign(envVars)
+	withWorkspace[WorkspaceEnvVar] = dir
+	return withWorkspace, nil
+}
+
+// RemoveWorkspaces deletes the workspaces of the document with the given id,
+// unless keep_workspaces is set
+func RemoveWorkspaces(docID int) {
+	workspacesMutex.Lock()
+	defer workspacesMutex.Unlock()
+	for key, dir := range workspaces {
+		if key.docID != docID {
+			continue
+		}
+		delete(workspaces, key)
+		if codeRunnerConfigs.KeepWorkspaces {
+			log.Infof("Keeping workspace %s of document %d in %s", key.name, docID, dir)
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Errorf("Couldn't remove workspace %s: %v", dir, err)
+		}
+	}
+}
+
+// RemoveAllWorkspaces deletes the workspaces of all documents, unless
+// keep_workspaces is set
+func RemoveAllWorkspaces() {
+	workspacesMutex.Lock()
+	docIDs := lo.Uniq(lo.Map(lo.Keys(workspaces), func(key workspaceKey, _ int) int {
+		return key.docID
+	}))
+	workspacesMutex.Unlock()
+
+	for _, docID := range docIDs {
+		RemoveWorkspaces(docID)
+	}
+}